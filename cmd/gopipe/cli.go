@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+	"github.com/frostbyte57/GoPipe/internal/words"
+	"github.com/frostbyte57/GoPipe/internal/wormhole"
+)
+
+// Exit codes of the non-interactive subcommands.
+const (
+	exitOK          = 0
+	exitFailure     = 1 // local problem, e.g. unreadable file or unwritable directory
+	exitUsage       = 2
+	exitMailbox     = 3 // mailbox server unreachable or refused the request
+	exitHandshake   = 4 // key exchange with the peer failed
+	exitTransfer    = 5 // connection to the peer or the data transfer failed
+	exitDeclined    = 6 // the receiver declined the offer
+	exitInterrupted = 130
+)
+
+// parseArgs parses fs and returns the positional arguments. Unlike
+// flag.FlagSet.Parse it also accepts flags after positional arguments, so
+// both "receive -output dir CODE" and "receive CODE -output dir" work.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// normalizeCode corrects a code as typed, telling the user if it changed.
+func normalizeCode(code string) (string, error) {
+	normalized, err := words.Normalize(code)
+	if err != nil {
+		return "", err
+	}
+	if normalized != code {
+		fmt.Fprintf(os.Stderr, "Using code %s\n", normalized)
+	}
+	return normalized, nil
+}
+
+// failure prints err and returns code, or exitInterrupted if ctx was
+// cancelled by a signal.
+func failure(ctx context.Context, code int, err error) int {
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "Interrupted.")
+		return exitInterrupted
+	}
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return code
+}
+
+// printProgress writes plain progress lines to stderr until ch is closed.
+// Lines are rate limited so that logs of large transfers stay readable.
+func printProgress(label string, ch <-chan wormhole.Progress, done chan<- struct{}) {
+	defer close(done)
+
+	var last wormhole.Progress
+	var lastPrint time.Time
+	printed, complete := true, false
+	for p := range ch {
+		if p.Reconnecting {
+			fmt.Fprintf(os.Stderr, "%s: connection lost, reconnecting…\n", label)
+			continue
+		}
+		// Once complete, the trailer of an archive adds nothing to show.
+		last, printed = p, complete && p.Ratio >= 1
+		if printed || time.Since(lastPrint) < time.Second && p.Ratio < 1 {
+			continue
+		}
+		lastPrint, printed, complete = time.Now(), true, p.Ratio >= 1
+		printProgressLine(label, p)
+	}
+	if !printed {
+		printProgressLine(label, last)
+	}
+}
+
+func printProgressLine(label string, p wormhole.Progress) {
+	var line string
+	if p.Total < 0 {
+		line = fmt.Sprintf("%s: %s, %s/s", label, byteCount(p.Current), byteCount(int64(p.Rate)))
+	} else {
+		line = fmt.Sprintf("%s: %s / %s (%.0f%%), %s/s",
+			label, byteCount(p.Current), byteCount(p.Total), p.Ratio*100, byteCount(int64(p.Rate)))
+	}
+	if p.FilesTotal > 0 {
+		line += fmt.Sprintf(", %d/%d files, %s", p.FilesDone, p.FilesTotal, p.File)
+		if p.FileTotal > 0 {
+			line += fmt.Sprintf(" (%.0f%%)", float64(p.FileCurrent)/float64(p.FileTotal)*100)
+		}
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+func byteCount(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// parseSize parses a byte count such as "4096", "700K", "1.5G" or "2GiB".
+// Suffixes are powers of 1024.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mult := 1.0
+	if n := len(num); n > 0 {
+		if i := strings.IndexByte("KMGTPE", num[n-1]); i >= 0 {
+			mult = float64(int64(1) << (10 * (i + 1)))
+			num = num[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * mult), nil
+}
+
+// describeOffer summarises what the sender offers.
+func describeOffer(meta transit.Metadata) string {
+	if meta.Mode == "multi" {
+		names := make([]string, len(meta.Entries))
+		for i, e := range meta.Entries {
+			names[i] = "'" + e.Name + "'"
+			if e.Mode == "dir" {
+				names[i] += fmt.Sprintf(" (directory, %d files)", e.Files)
+			}
+		}
+		return fmt.Sprintf("%d items (%d files, %s): %s",
+			len(meta.Entries), meta.Files, byteCount(meta.RawSize), strings.Join(names, ", "))
+	}
+	if meta.Mode == "dir" {
+		size := meta.RawSize
+		if size == 0 {
+			size = meta.Size
+		}
+		return fmt.Sprintf("directory '%s' (%d files, %s)", meta.Name, meta.Files, byteCount(size))
+	}
+	if meta.Size < 0 {
+		return fmt.Sprintf("stream '%s' (size unknown)", meta.Name)
+	}
+	return fmt.Sprintf("file '%s' (%s)", meta.Name, byteCount(meta.Size))
+}
+
+// checkVerifier shows the verifier and, with -verify, asks whether the peer
+// shows the same before anything is sent or accepted.
+func checkVerifier(ctx context.Context, c *wormhole.Client, verify bool) error {
+	fmt.Fprintf(os.Stderr, "Verifier: %s\n", words.Verifier(c.Verifier()))
+	if !verify {
+		return nil
+	}
+	ok, err := confirm(ctx, "Does the peer show the same verifier? [y/N] ")
+	if ok || ctx.Err() != nil {
+		return err
+	}
+	c.RejectVerifier(ctx)
+	if err != nil {
+		return err
+	}
+	return wormhole.ErrVerifierMismatch
+}
+
+// errNoAnswer is returned by confirm if its input ends without an answer,
+// e.g. when there is no terminal and stdin is /dev/null in a script.
+var errNoAnswer = errors.New("no answer to the question")
+
+// openTerminal opens the terminal for reading, so that questions can be
+// asked while stdin carries the data to send.
+func openTerminal() (*os.File, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	return os.Open(name)
+}
+
+// haveTerminal reports whether -verify can ask its question on the terminal
+// while stdin is taken, because of why, and explains otherwise.
+func haveTerminal(why string) bool {
+	tty, err := openTerminal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -verify needs a terminal to ask on when %s\n", why)
+		return false
+	}
+	tty.Close()
+	return true
+}
+
+// confirm asks a yes/no question and reads the answer from the terminal, or
+// from stdin if there is none.
+func confirm(ctx context.Context, question string) (bool, error) {
+	in := io.Reader(os.Stdin)
+	if tty, err := openTerminal(); err == nil {
+		defer tty.Close()
+		in = tty
+	}
+	fmt.Fprint(os.Stderr, question)
+
+	type reply struct {
+		line string
+		err  error
+	}
+	answer := make(chan reply, 1)
+	go func() {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		answer <- reply{line, err}
+	}()
+	select {
+	case r := <-answer:
+		switch strings.ToLower(strings.TrimSpace(r.line)) {
+		case "y", "yes":
+			return true, nil
+		case "":
+			if r.err != nil {
+				fmt.Fprintln(os.Stderr)
+				return false, errNoAnswer
+			}
+		}
+		return false, nil
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return false, ctx.Err()
+	}
+}
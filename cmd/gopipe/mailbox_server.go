@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/frostbyte57/GoPipe/internal/mailbox"
+)
+
+func runMailboxServer(args []string) int {
+	fs := flag.NewFlagSet("mailbox-server", flag.ContinueOnError)
+	listen := fs.String("listen", ":4000", "TCP address to listen on")
+	motd := fs.String("motd", "", "Message of the day sent to every client")
+	ttl := fs.Duration("mailbox-ttl", mailbox.DefaultMailboxTTL, "How long abandoned mailboxes are kept")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gopipe mailbox-server [flags]")
+		fs.PrintDefaults()
+	}
+	if _, err := parseArgs(fs, args); err != nil {
+		return exitUsage
+	}
+
+	srv := mailbox.NewServer()
+	srv.MOTD = *motd
+	srv.MailboxTTL = *ttl
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1", srv)
+	httpSrv := &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+	fmt.Fprintf(os.Stderr, "Mailbox server listening on ws://%s/v1\n", l.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+		httpSrv.Shutdown(context.Background())
+	}()
+
+	if err := httpSrv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
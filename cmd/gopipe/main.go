@@ -7,16 +7,48 @@ import (
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/frostbyte57/GoPipe/internal/mailbox"
+	"github.com/frostbyte57/GoPipe/internal/transit"
 	"github.com/frostbyte57/GoPipe/ui"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "send":
+			os.Exit(runSend(os.Args[2:]))
+		case "receive":
+			os.Exit(runReceive(os.Args[2:]))
+		case "session":
+			os.Exit(runSession(os.Args[2:]))
+		case "mailbox-server":
+			os.Exit(runMailboxServer(os.Args[2:]))
+		case "relay-server":
+			os.Exit(runRelayServer(os.Args[2:]))
+		}
+	}
+
 	mailboxURL := flag.String("mailbox", mailbox.DefaultURL, "WebSocket URL of the Mailbox Server")
+	relay := flag.String("relay", transit.DefaultRelay, "Transit relay address (host:port), empty to disable")
+	verify := flag.Bool("verify", false, "Wait for confirmation that both sides show the same verifier (only GoPipe clients show these words)")
+	flag.Usage = usage
 	flag.Parse()
 
-	p := tea.NewProgram(ui.InitialModel(*mailboxURL))
+	p := tea.NewProgram(ui.InitialModel(*mailboxURL, *relay, *verify))
 	if _, err := p.Run(); err != nil {
 		fmt.Printf("Alas, there's been an error: %v", err)
 		os.Exit(1)
 	}
 }
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  gopipe [-mailbox URL] [-relay addr] [-verify]  start the interactive TUI
+  gopipe send [flags] <path>...                  send files or directories
+  gopipe receive [flags] [code] [--output dir]   receive using a wormhole code, or generate one
+  gopipe session [flags] [code]                  open or join a session for several transfers
+  gopipe mailbox-server [-listen addr]           run a self-hosted mailbox server
+  gopipe relay-server [-listen addr]             run a self-hosted transit relay
+
+Run "gopipe <command> -h" for the flags of a command.
+`)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/frostbyte57/GoPipe/internal/mailbox"
+	"github.com/frostbyte57/GoPipe/internal/transit"
+	"github.com/frostbyte57/GoPipe/internal/words"
+	"github.com/frostbyte57/GoPipe/internal/wormhole"
+)
+
+func runReceive(args []string) int {
+	fs := flag.NewFlagSet("receive", flag.ContinueOnError)
+	mailboxURL := fs.String("mailbox", mailbox.DefaultURL, "WebSocket URL of the Mailbox Server")
+	relay := fs.String("relay", transit.DefaultRelay, "Transit relay address (host:port), empty to disable")
+	outDir := fs.String("output", ".", "Directory to save the received file in, or - to write it to stdout")
+	fs.StringVar(outDir, "o", ".", "Shorthand for -output")
+	zipDirs := fs.Bool("zip", false, "Save received directories as a .zip archive instead of unpacking them")
+	accept := fs.Bool("accept", false, "Accept the offer without asking")
+	verify := fs.Bool("verify", false, "Wait for confirmation that both sides show the same verifier (only GoPipe clients show these words)")
+	codeLength := fs.Int("code-length", words.DefaultLength, "Number of words in the code generated when none is given")
+	var maxSize int64
+	fs.Func("max-size", "Decline offers larger than this many bytes (suffixes K, M, G, T)", func(s string) (err error) {
+		maxSize, err = parseSize(s)
+		return err
+	})
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gopipe receive [flags] <code>")
+		fmt.Fprintln(fs.Output(), "       gopipe receive [flags]          (generate a code for the sender to use)")
+		fs.PrintDefaults()
+	}
+
+	codes, err := parseArgs(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(codes) > 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if len(codes) == 1 {
+		if codes[0], err = normalizeCode(codes[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	toStdout := *outDir == "-"
+	if !toStdout {
+		if info, err := os.Stat(*outDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailure
+		} else if !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "Error: %s is not a directory\n", *outDir)
+			return exitFailure
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := wormhole.NewClient("", *mailboxURL, *relay)
+	c.SetZipDirectories(*zipDirs)
+	c.SetCodeLength(*codeLength)
+	if len(codes) == 1 {
+		if err := c.PrepareReceive(ctx, codes[0]); err != nil {
+			return failure(ctx, exitMailbox, err)
+		}
+	} else {
+		code, err := c.PrepareRequest(ctx)
+		if err != nil {
+			return failure(ctx, exitMailbox, err)
+		}
+		fmt.Fprintf(os.Stderr, "Wormhole code is: %s\n", code)
+		fmt.Fprintf(os.Stderr, "On the other computer, run: gopipe send -code %s <path>\n", code)
+	}
+	if _, err := c.PerformHandshake(ctx); err != nil {
+		return failure(ctx, exitHandshake, err)
+	}
+	if err := checkVerifier(ctx, c, *verify); err != nil {
+		return failure(ctx, exitHandshake, err)
+	}
+	fmt.Fprintln(os.Stderr, "Connected to sender, waiting for the offer...")
+
+	meta, err := c.ReceiveOffer(ctx)
+	if err != nil {
+		return failure(ctx, exitTransfer, err)
+	}
+	if meta.Mode == "session" {
+		c.RejectOffer(ctx)
+		fmt.Fprintln(os.Stderr, "The sender opened a session; ask for a new code and join it with \"gopipe session <code>\".")
+		return exitDeclined
+	}
+	if meta.Mode == "text" {
+		text, err := c.ReceiveText(ctx)
+		if err != nil {
+			return failure(ctx, exitTransfer, err)
+		}
+		// The message goes to stdout so that it can be piped; everything
+		// else is on stderr.
+		fmt.Println(text)
+		return exitOK
+	}
+	fmt.Fprintf(os.Stderr, "Sender offers %s.\n", describeOffer(meta))
+	if maxSize > 0 && meta.Size > maxSize {
+		c.RejectOffer(ctx)
+		fmt.Fprintf(os.Stderr, "Declined: larger than -max-size (%s).\n", byteCount(maxSize))
+		return exitDeclined
+	}
+	if maxSize > 0 && meta.Size < 0 {
+		c.RejectOffer(ctx)
+		fmt.Fprintln(os.Stderr, "Declined: the size is not known in advance, so -max-size cannot be checked.")
+		return exitDeclined
+	}
+	if !*accept {
+		ok, err := confirm(ctx, "Accept? [y/N] ")
+		if err != nil && ctx.Err() != nil {
+			return failure(ctx, exitDeclined, err)
+		}
+		if !ok {
+			c.RejectOffer(ctx)
+			if errors.Is(err, errNoAnswer) {
+				fmt.Fprintf(os.Stderr, "Declined: %v, pass -accept to receive without asking.\n", err)
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Declined: %v.\n", err)
+			} else {
+				fmt.Fprintln(os.Stderr, "Declined.")
+			}
+			return exitDeclined
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Receiving...")
+
+	progressCh := make(chan wormhole.Progress, 100)
+	printed := make(chan struct{})
+	go printProgress("Receiving", progressCh, printed)
+
+	var name string
+	if toStdout {
+		err = c.ReceiveStream(ctx, os.Stdout, progressCh)
+	} else {
+		name, err = c.ReceiveFile(ctx, *outDir, progressCh)
+	}
+	close(progressCh)
+	<-printed
+	if errors.Is(err, wormhole.ErrNoSpace) {
+		return failure(ctx, exitFailure, err)
+	}
+	if err != nil {
+		return failure(ctx, exitTransfer, err)
+	}
+
+	switch {
+	case toStdout:
+		fmt.Fprintln(os.Stderr, "Received file.")
+	case meta.Mode == "multi":
+		fmt.Fprintf(os.Stderr, "Received %d items, saved as %s.\n", len(meta.Entries), name)
+	default:
+		fmt.Fprintf(os.Stderr, "Received file, saved as '%s'.\n", name)
+	}
+	return exitOK
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+func runRelayServer(args []string) int {
+	fs := flag.NewFlagSet("relay-server", flag.ContinueOnError)
+	listen := fs.String("listen", ":4001", "TCP address to listen on")
+	pending := fs.Duration("pending-timeout", transit.DefaultRelayPendingTimeout, "How long a client waits for its peer")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gopipe relay-server [flags]")
+		fs.PrintDefaults()
+	}
+	if _, err := parseArgs(fs, args); err != nil {
+		return exitUsage
+	}
+
+	srv := transit.NewRelayServer()
+	srv.PendingTimeout = *pending
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+	fmt.Fprintf(os.Stderr, "Transit relay listening on %s\n", l.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+
+	"github.com/frostbyte57/GoPipe/internal/mailbox"
+	"github.com/frostbyte57/GoPipe/internal/transit"
+	"github.com/frostbyte57/GoPipe/internal/words"
+	"github.com/frostbyte57/GoPipe/internal/wormhole"
+)
+
+func runSend(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	mailboxURL := fs.String("mailbox", mailbox.DefaultURL, "WebSocket URL of the Mailbox Server")
+	relay := fs.String("relay", transit.DefaultRelay, "Transit relay address (host:port), empty to disable")
+	text := fs.String("text", "", "Send this text message instead of a file")
+	name := fs.String("name", "stdin", "File name to offer when sending from stdin")
+	code := fs.String("code", "", "Send to the receiver that generated this code, instead of generating one")
+	verify := fs.Bool("verify", false, "Wait for confirmation that both sides show the same verifier (only GoPipe clients show these words)")
+	codeLength := fs.Int("code-length", words.DefaultLength, "Number of words in the generated code")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gopipe send [flags] <path>...")
+		fmt.Fprintln(fs.Output(), "       gopipe send [flags] -      (send stdin)")
+		fmt.Fprintln(fs.Output(), "       gopipe send [flags] -text <message>")
+		fmt.Fprintln(fs.Output(), "       gopipe send [flags] -code <code> <path>...   (answer a request from \"gopipe receive\")")
+		fs.PrintDefaults()
+	}
+
+	paths, err := parseArgs(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	textMode := *text != ""
+	stdin := len(paths) == 1 && paths[0] == "-"
+	if textMode && len(paths) != 0 || !textMode && len(paths) == 0 || !stdin && slices.Contains(paths, "-") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if *verify && stdin && !haveTerminal("sending stdin") {
+		return exitUsage
+	}
+
+	if *code != "" {
+		if *code, err = normalizeCode(*code); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitUsage
+		}
+	}
+	if !textMode && !stdin {
+		if paths, err = wormhole.ExpandPaths(paths); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailure
+		}
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return exitFailure
+			}
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := wormhole.NewClient("", *mailboxURL, *relay)
+	c.SetCodeLength(*codeLength)
+	if *code != "" {
+		if err := c.PrepareSendCode(ctx, *code); err != nil {
+			return failure(ctx, exitMailbox, err)
+		}
+	} else {
+		code, err := c.PrepareSend(ctx)
+		if err != nil {
+			return failure(ctx, exitMailbox, err)
+		}
+		fmt.Fprintf(os.Stderr, "Wormhole code is: %s\n", code)
+		fmt.Fprintf(os.Stderr, "On the other computer, run: gopipe receive %s\n", code)
+	}
+
+	if _, err := c.PerformHandshake(ctx); err != nil {
+		return failure(ctx, exitHandshake, err)
+	}
+	if err := checkVerifier(ctx, c, *verify); err != nil {
+		return failure(ctx, exitHandshake, err)
+	}
+
+	if textMode {
+		fmt.Fprintln(os.Stderr, "Receiver connected, sending text...")
+		err := c.SendText(ctx, *text)
+		if errors.Is(err, wormhole.ErrDeclined) {
+			return failure(ctx, exitDeclined, err)
+		}
+		if err != nil {
+			return failure(ctx, exitTransfer, err)
+		}
+		fmt.Fprintln(os.Stderr, "Text message sent.")
+		return exitOK
+	}
+
+	fmt.Fprintln(os.Stderr, "Receiver connected, sending...")
+
+	progressCh := make(chan wormhole.Progress, 100)
+	printed := make(chan struct{})
+	switch {
+	case stdin:
+		go printProgress("Sending "+*name, progressCh, printed)
+		err = c.SendStream(ctx, *name, os.Stdin, progressCh)
+	case len(paths) > 1:
+		go printProgress(fmt.Sprintf("Sending %d items", len(paths)), progressCh, printed)
+		err = c.SendFiles(ctx, paths, progressCh)
+	default:
+		go printProgress("Sending "+filepath.Base(paths[0]), progressCh, printed)
+		err = c.SendFile(ctx, paths[0], progressCh)
+	}
+	close(progressCh)
+	<-printed
+	if errors.Is(err, wormhole.ErrDeclined) {
+		return failure(ctx, exitDeclined, err)
+	}
+	if err != nil {
+		return failure(ctx, exitTransfer, err)
+	}
+
+	fmt.Fprintln(os.Stderr, "Transfer complete.")
+	return exitOK
+}
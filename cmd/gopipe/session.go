@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/frostbyte57/GoPipe/internal/mailbox"
+	"github.com/frostbyte57/GoPipe/internal/transit"
+	"github.com/frostbyte57/GoPipe/internal/words"
+	"github.com/frostbyte57/GoPipe/internal/wormhole"
+)
+
+// runSession keeps the connection to the peer open, so that both sides can
+// send files and text, typed as commands on stdin, until one of them closes
+// the session. Joining with the code is the consent to receive: what the peer
+// sends is saved without asking.
+func runSession(args []string) int {
+	fs := flag.NewFlagSet("session", flag.ContinueOnError)
+	mailboxURL := fs.String("mailbox", mailbox.DefaultURL, "WebSocket URL of the Mailbox Server")
+	relay := fs.String("relay", transit.DefaultRelay, "Transit relay address (host:port), empty to disable")
+	outDir := fs.String("output", ".", "Directory to save received files in")
+	fs.StringVar(outDir, "o", ".", "Shorthand for -output")
+	zipDirs := fs.Bool("zip", false, "Save received directories as a .zip archive instead of unpacking them")
+	verify := fs.Bool("verify", false, "Wait for confirmation that both sides show the same verifier (only GoPipe clients show these words)")
+	codeLength := fs.Int("code-length", words.DefaultLength, "Number of words in the generated code")
+	var maxSize int64
+	fs.Func("max-size", "Decline offers larger than this many bytes (suffixes K, M, G, T)", func(s string) (err error) {
+		maxSize, err = parseSize(s)
+		return err
+	})
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gopipe session [flags]          (open a session and print its code)")
+		fmt.Fprintln(fs.Output(), "       gopipe session [flags] <code>   (join a session)")
+		fmt.Fprintln(fs.Output(), "Commands on stdin: send <path>..., text <message>, close")
+		fs.PrintDefaults()
+	}
+
+	codes, err := parseArgs(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(codes) > 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if len(codes) == 1 {
+		if codes[0], err = normalizeCode(codes[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitUsage
+		}
+	}
+	if *verify && !haveTerminal("commands come on stdin") {
+		return exitUsage
+	}
+	if info, err := os.Stat(*outDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	} else if !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "Error: %s is not a directory\n", *outDir)
+		return exitFailure
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := wormhole.NewClient("", *mailboxURL, *relay)
+	c.SetZipDirectories(*zipDirs)
+	c.SetCodeLength(*codeLength)
+	var s *wormhole.Session
+	if len(codes) == 0 {
+		code, err := c.PrepareSend(ctx)
+		if err != nil {
+			return failure(ctx, exitMailbox, err)
+		}
+		fmt.Fprintf(os.Stderr, "Session code is: %s\n", code)
+		fmt.Fprintf(os.Stderr, "On the other computer, run: gopipe session %s\n", code)
+		if _, err := c.PerformHandshake(ctx); err != nil {
+			return failure(ctx, exitHandshake, err)
+		}
+		if err := checkVerifier(ctx, c, *verify); err != nil {
+			return failure(ctx, exitHandshake, err)
+		}
+		s, err = c.OpenSession(ctx)
+		if errors.Is(err, wormhole.ErrDeclined) {
+			return failure(ctx, exitDeclined, err)
+		}
+		if err != nil {
+			return failure(ctx, exitTransfer, err)
+		}
+	} else {
+		if err := c.PrepareReceive(ctx, codes[0]); err != nil {
+			return failure(ctx, exitMailbox, err)
+		}
+		if _, err := c.PerformHandshake(ctx); err != nil {
+			return failure(ctx, exitHandshake, err)
+		}
+		if err := checkVerifier(ctx, c, *verify); err != nil {
+			return failure(ctx, exitHandshake, err)
+		}
+		if s, err = c.AcceptSession(ctx); err != nil {
+			return failure(ctx, exitTransfer, err)
+		}
+	}
+	fmt.Fprintln(os.Stderr, `Session open. Type "send <path>...", "text <message>" or "close".`)
+
+	sess := &cliSession{s: s, ctx: ctx, outDir: *outDir, maxSize: maxSize}
+	go sess.receive()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+loop:
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok || !sess.command(line) {
+				break loop
+			}
+		case <-s.Done():
+			fmt.Fprintln(os.Stderr, "The peer closed the session.")
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	if ctx.Err() == nil {
+		// Let the transfers already started finish first.
+		sess.stop()
+	}
+	err = s.Close()
+	sess.stop()
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "Interrupted.")
+		return exitInterrupted
+	}
+	if err != nil {
+		return failure(ctx, exitTransfer, err)
+	}
+	fmt.Fprintln(os.Stderr, "Session closed.")
+	return exitOK
+}
+
+// cliSession runs the transfers of a session in the background.
+type cliSession struct {
+	s       *wormhole.Session
+	ctx     context.Context
+	outDir  string
+	maxSize int64
+
+	mu      sync.Mutex
+	stopped bool // no new transfers are started
+	running sync.WaitGroup
+}
+
+// command runs one line typed by the user. It returns false for "close".
+func (cs *cliSession) command(line string) bool {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case "":
+	case "close", "quit", "exit":
+		return false
+	case "send":
+		paths, err := wormhole.ExpandPaths(wormhole.SplitPaths(arg))
+		if err == nil && len(paths) == 0 {
+			err = errors.New("nothing to send")
+		}
+		for _, path := range paths {
+			if err == nil {
+				_, err = os.Stat(path)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return true
+		}
+		label := filepath.Base(paths[0])
+		if len(paths) > 1 {
+			label = fmt.Sprintf("%d items", len(paths))
+		}
+		cs.start(func() { cs.send(label, paths) })
+	case "text":
+		if arg == "" {
+			fmt.Fprintln(os.Stderr, "Error: nothing to send")
+			return true
+		}
+		cs.start(func() {
+			if err := cs.s.SendText(cs.ctx, arg); err != nil {
+				fmt.Fprintf(os.Stderr, "Sending text failed: %v\n", err)
+				return
+			}
+			fmt.Fprintln(os.Stderr, "Text message sent.")
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q. Type \"send <path>...\", \"text <message>\" or \"close\".\n", cmd)
+	}
+	return true
+}
+
+func (cs *cliSession) send(label string, paths []string) {
+	progressCh := make(chan wormhole.Progress, 100)
+	printed := make(chan struct{})
+	go printProgress("Sending "+label, progressCh, printed)
+	err := cs.s.Send(cs.ctx, paths, progressCh)
+	close(progressCh)
+	<-printed
+	switch {
+	case errors.Is(err, wormhole.ErrDeclined):
+		fmt.Fprintf(os.Stderr, "The peer declined %s.\n", label)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Sending %s failed: %v\n", label, err)
+	default:
+		fmt.Fprintf(os.Stderr, "Sent %s.\n", label)
+	}
+}
+
+// receive saves what the peer sends until the session ends.
+func (cs *cliSession) receive() {
+	for in := range cs.s.Incoming() {
+		if in.Meta.Mode == "text" {
+			fmt.Fprintln(os.Stderr, "Text message from the peer:")
+			fmt.Println(in.Text)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "The peer sends %s.\n", describeOffer(in.Meta))
+		if cs.maxSize > 0 && (in.Meta.Size > cs.maxSize || in.Meta.Size < 0) {
+			in.Reject()
+			fmt.Fprintf(os.Stderr, "Declined: larger than -max-size (%s), or of unknown size.\n", byteCount(cs.maxSize))
+			continue
+		}
+		if !cs.start(func() { cs.accept(in) }) {
+			in.Reject()
+		}
+	}
+}
+
+func (cs *cliSession) accept(in *wormhole.Incoming) {
+	progressCh := make(chan wormhole.Progress, 100)
+	printed := make(chan struct{})
+	go printProgress("Receiving "+in.Meta.Name, progressCh, printed)
+	name, err := in.Accept(cs.ctx, cs.outDir, progressCh)
+	close(progressCh)
+	<-printed
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Receiving %s failed: %v\n", in.Meta.Name, err)
+	case in.Meta.Mode == "multi":
+		fmt.Fprintf(os.Stderr, "Received %d items, saved as %s.\n", len(in.Meta.Entries), name)
+	default:
+		fmt.Fprintf(os.Stderr, "Received %s, saved as '%s'.\n", in.Meta.Name, name)
+	}
+}
+
+// start runs fn in the background, unless the session is being closed.
+func (cs *cliSession) start(fn func()) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.stopped {
+		return false
+	}
+	cs.running.Add(1)
+	go func() {
+		defer cs.running.Done()
+		fn()
+	}()
+	return true
+}
+
+// stop refuses new transfers and waits for the running ones.
+func (cs *cliSession) stop() {
+	cs.mu.Lock()
+	cs.stopped = true
+	cs.mu.Unlock()
+	cs.running.Wait()
+}
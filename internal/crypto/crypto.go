@@ -17,7 +17,26 @@ func DeriveKey(secret []byte, salt []byte, info string) []byte {
 	return key
 }
 
+// DerivePhaseKey derives the key for a mailbox message, bound to the side that
+// sends it and the phase it is sent in.
+func DerivePhaseKey(key []byte, side, phase string) []byte {
+	sideHash := sha256.Sum256([]byte(side))
+	phaseHash := sha256.Sum256([]byte(phase))
+	purpose := "wormhole:phase:" + string(sideHash[:]) + string(phaseHash[:])
+	return DeriveKey(key, nil, purpose)
+}
+
 func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return EncryptWithNonce(key, nonce, plaintext)
+}
+
+// EncryptWithNonce is Encrypt with a caller-chosen nonce, for protocols that
+// use counters. The nonce must never be reused with the same key.
+func EncryptWithNonce(key []byte, nonce [24]byte, plaintext []byte) ([]byte, error) {
 	if len(key) != 32 {
 		return nil, fmt.Errorf("invalid key length: %d", len(key))
 	}
@@ -25,11 +44,6 @@ func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
 	var secretKey [32]byte
 	copy(secretKey[:], key)
 
-	var nonce [24]byte
-	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
-		return nil, err
-	}
-
 	// seal appends to out, so we start with nonce to be friendly
 	encrypted := secretbox.Seal(nonce[:], plaintext, &nonce, &secretKey)
 	return encrypted, nil
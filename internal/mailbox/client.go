@@ -2,7 +2,10 @@ package mailbox
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -12,14 +15,50 @@ import (
 
 const DefaultURL = "ws://relay.magic-wormhole.io:4000/v1"
 
+// ErrClosed is returned by Next once the connection to the server is gone.
+var ErrClosed = errors.New("mailbox connection closed")
+
+// ErrAllocationLost is returned by Allocate if the connection broke after
+// the request was sent. The server may have allocated a nameplate, but its
+// answer is lost with the connection.
+var ErrAllocationLost = errors.New("connection to the mailbox server lost while allocating a nameplate")
+
+// ServerError is an "error" message from the server, which rejected one of
+// our requests.
+type ServerError struct {
+	Message string
+	Request string // type of the rejected request, if the server said
+}
+
+func (e *ServerError) Error() string {
+	if e.Request == "" {
+		return "mailbox server: " + e.Message
+	}
+	return fmt.Sprintf("mailbox server rejected %s: %s", e.Request, e.Message)
+}
+
+// Client is a connection to a mailbox server. Every request gets an ID, and
+// the method making it returns once the server answered it, with the error
+// the server rejected it with, if any. Every other message from the server,
+// including the typed replies, is delivered on EventChan as its typed struct,
+// e.g. ClaimedMessage, in the order received; Next reads them and turns
+// "error" messages into errors.
+//
+// If the connection drops, the client reconnects and restores what the
+// server knew about it, so users of EventChan do not notice.
 type Client struct {
-	conn  *websocket.Conn
 	url   string
 	appID string
 	side  string
 
 	EventChan chan interface{}
-	errChan   chan error
+
+	mu    sync.Mutex
+	conn  *websocket.Conn // nil while reconnecting
+	state clientState
+	calls []*call       // requests waiting for their answer, oldest first
+	pings int           // the last number sent in a ping
+	done  chan struct{} // closed by Close
 
 	closeOnce sync.Once
 }
@@ -33,99 +72,384 @@ func NewClient(url, appID, side string) *Client {
 		appID:     appID,
 		side:      side,
 		EventChan: make(chan interface{}, 100),
-		errChan:   make(chan error, 1),
+		state:     clientState{seen: make(map[string]bool)},
+		done:      make(chan struct{}),
 	}
 }
 
 func (c *Client) Connect(ctx context.Context) error {
-	conn, _, err := websocket.Dial(ctx, c.url, nil)
+	conn, welcome, err := c.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to dial: %w", err)
+		return err
 	}
+	c.EventChan <- welcome
+	c.mu.Lock()
 	c.conn = conn
+	c.mu.Unlock()
+
+	go c.readLoop(conn)
+	return nil
+}
 
-	// Read welcome message
+// dial opens a connection and binds it to our side.
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, WelcomeMessage, error) {
 	var welcome WelcomeMessage
-	if err := wsjson.Read(ctx, c.conn, &welcome); err != nil {
-		return fmt.Errorf("failed to read welcome: %w", err)
+	conn, _, err := websocket.Dial(ctx, c.url, nil)
+	if err != nil {
+		return nil, welcome, fmt.Errorf("failed to dial: %w", err)
+	}
+
+	if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+		conn.Close(websocket.StatusProtocolError, "")
+		return nil, welcome, fmt.Errorf("failed to read welcome: %w", err)
 	}
-	c.EventChan <- welcome
 
 	bind := BindMessage{
-		Type:  "bind",
-		AppID: c.appID,
-		Side:  c.side,
+		Type:          "bind",
+		ID:            randomID(),
+		AppID:         c.appID,
+		Side:          c.side,
+		ClientVersion: []string{"go", "gopipe"},
 	}
-	if err := wsjson.Write(ctx, c.conn, bind); err != nil {
-		return fmt.Errorf("failed to send bind: %w", err)
+	if err := wsjson.Write(ctx, conn, bind); err != nil {
+		conn.Close(websocket.StatusInternalError, "")
+		return nil, welcome, fmt.Errorf("failed to send bind: %w", err)
 	}
-
-	go c.readLoop()
-	return nil
+	return conn, welcome, nil
 }
 
-func (c *Client) readLoop() {
+func (c *Client) readLoop(conn *websocket.Conn) {
+	defer close(c.EventChan)
+	stop := c.keepalive(conn)
 	for {
 		var raw json.RawMessage
-		err := wsjson.Read(context.Background(), c.conn, &raw)
-		if err != nil {
-			close(c.EventChan)
-			return
+		if err := wsjson.Read(context.Background(), conn, &raw); err != nil {
+			stop()
+			if conn = c.reconnect(); conn == nil {
+				c.Close()
+				return
+			}
+			stop = c.keepalive(conn)
+			continue
 		}
 
-		var generic GenericInMessage
-		if err := json.Unmarshal(raw, &generic); err != nil {
+		ev, err := decodeEvent(raw)
+		if err != nil {
 			continue
 		}
+		c.mu.Lock()
+		deliver := c.state.received(ev, c.side)
+		if c.answer(ev) {
+			// An error returned by the call that caused it.
+			deliver = false
+		}
+		c.mu.Unlock()
+		if deliver {
+			c.EventChan <- ev
+		}
+	}
+}
+
+// decodeEvent decodes a message from the server into its typed struct.
+// Messages of unknown types are skipped, as the protocol may grow.
+func decodeEvent(raw json.RawMessage) (interface{}, error) {
+	var generic GenericInMessage
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return nil, err
+	}
+	switch generic.Type {
+	case "welcome":
+		return decode[WelcomeMessage](raw)
+	case "ack":
+		return decode[AckMessage](raw)
+	case "error":
+		return decode[ErrorMessage](raw)
+	case "nameplates":
+		return decode[NameplatesMessage](raw)
+	case "allocated":
+		return decode[AllocatedMessage](raw)
+	case "claimed":
+		return decode[ClaimedMessage](raw)
+	case "released":
+		return decode[ReleasedMessage](raw)
+	case "message":
+		return decode[MessageMessage](raw)
+	case "closed":
+		return decode[ClosedMessage](raw)
+	case "pong":
+		return decode[PongMessage](raw)
+	}
+	return nil, fmt.Errorf("unknown message type %q", generic.Type)
+}
+
+func decode[T any](raw json.RawMessage) (interface{}, error) {
+	var msg T
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Next waits for the next event from the server. An "error" message is
+// returned as a *ServerError, so that whoever waits for a reply learns that
+// the request failed instead of waiting until ctx is done.
+func (c *Client) Next(ctx context.Context) (interface{}, error) {
+	select {
+	case ev, ok := <-c.EventChan:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if msg, ok := ev.(ErrorMessage); ok {
+			return nil, serverError(msg)
+		}
+		return ev, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func serverError(msg ErrorMessage) *ServerError {
+	orig := msg.request()
+	return &ServerError{Message: msg.Error, Request: orig.Type}
+}
+
+// call is a request waiting for the server's answer.
+type call struct {
+	id    string
+	reply func(ev interface{}) bool // reports whether ev answers the request; nil if only an ack does
+	done  chan error
+}
 
-		switch generic.Type {
-		case "allocated":
-			var msg AllocatedMessage
-			json.Unmarshal(raw, &msg)
-			c.EventChan <- msg
-		case "claimed":
-			var msg ClaimedMessage
-			json.Unmarshal(raw, &msg)
-			c.EventChan <- msg
-		case "message":
-			var msg MessageMessage
-			json.Unmarshal(raw, &msg)
-			c.EventChan <- msg
-		case "welcome":
-		case "error":
-		case "ack":
+// answer completes the oldest call that ev answers. It reports whether ev is
+// an error that was returned to the call. c.mu must be held.
+func (c *Client) answer(ev interface{}) bool {
+	for i, cl := range c.calls {
+		var err error
+		switch msg := ev.(type) {
+		case AckMessage:
+			if cl.reply != nil || msg.ID != cl.id {
+				continue
+			}
+		case ErrorMessage:
+			if msg.request().ID != cl.id {
+				continue
+			}
+			err = serverError(msg)
+		default:
+			if cl.reply == nil || !cl.reply(ev) {
+				continue
+			}
 		}
+		c.calls = append(c.calls[:i], c.calls[i+1:]...)
+		cl.done <- err
+		return err != nil
 	}
+	return false
 }
 
+// fail completes the call for the request with the given ID with err.
+// c.mu must be held.
+func (c *Client) fail(id string, err error) {
+	for i, cl := range c.calls {
+		if cl.id == id {
+			c.calls = append(c.calls[:i], c.calls[i+1:]...)
+			cl.done <- err
+			return
+		}
+	}
+}
+
+// forget stops waiting for the answer to cl.
+func (c *Client) forget(cl *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.calls {
+		if c.calls[i] == cl {
+			c.calls = append(c.calls[:i], c.calls[i+1:]...)
+			return
+		}
+	}
+}
+
+// call sends a request with the given ID and waits until reply reports true
+// for an event from the server, or, if reply is nil, until the server
+// acknowledges the request. If the server rejects it, the error is returned
+// as a *ServerError. A request made while reconnecting is answered once the
+// client has reconnected.
+func (c *Client) call(ctx context.Context, id string, v interface{}, reply func(ev interface{}) bool) error {
+	cl := c.expect(id, reply)
+	if err := c.Write(ctx, v); err != nil {
+		c.forget(cl)
+		return err
+	}
+	return c.wait(ctx, cl)
+}
+
+// expect registers a call for the request with the given ID, to be made
+// next.
+func (c *Client) expect(id string, reply func(ev interface{}) bool) *call {
+	cl := &call{id: id, reply: reply, done: make(chan error, 1)}
+	c.mu.Lock()
+	c.calls = append(c.calls, cl)
+	c.mu.Unlock()
+	return cl
+}
+
+// wait waits for the answer to cl.
+func (c *Client) wait(ctx context.Context, cl *call) error {
+	select {
+	case err := <-cl.done:
+		return err
+	case <-ctx.Done():
+		c.forget(cl)
+		return ctx.Err()
+	case <-c.done:
+		c.forget(cl)
+		return ErrClosed
+	}
+}
+
+// is reports whether ev is a T, to wait for replies of that type.
+func is[T any](ev interface{}) bool {
+	_, ok := ev.(T)
+	return ok
+}
+
+// Write sends a request to the server without waiting for the answer. While
+// the connection is down the request is kept, and sent once the client has
+// reconnected.
 func (c *Client) Write(ctx context.Context, v interface{}) error {
-	return wsjson.Write(ctx, c.conn, v)
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	conn := c.conn
+	c.state.sent(v, conn != nil)
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	err := wsjson.Write(ctx, conn, v)
+	if err != nil && ctx.Err() == nil && !c.isClosed() {
+		// Let the read loop reconnect; it sends the request again.
+		conn.Close(websocket.StatusGoingAway, "write failed")
+		return nil
+	}
+	return err
 }
 
+// Allocate asks for a free nameplate. The server answers with an
+// AllocatedMessage. If the connection breaks before the answer came, the
+// request is not sent again, and ErrAllocationLost is returned.
 func (c *Client) Allocate(ctx context.Context) error {
-	return c.Write(ctx, AllocateMessage{Type: "allocate"})
+	id := randomID()
+	return c.call(ctx, id, AllocateMessage{Type: "allocate", ID: id}, is[AllocatedMessage])
+}
+
+// List asks for the nameplates in use. The server answers with a
+// NameplatesMessage.
+func (c *Client) List(ctx context.Context) error {
+	id := randomID()
+	return c.call(ctx, id, ListMessage{Type: "list", ID: id}, is[NameplatesMessage])
 }
 
+// Claim claims a nameplate. The server answers with a ClaimedMessage naming
+// the mailbox it points to.
 func (c *Client) Claim(ctx context.Context, nameplate string) error {
-	return c.Write(ctx, ClaimMessage{Type: "claim", Nameplate: nameplate})
+	id := randomID()
+	return c.call(ctx, id, ClaimMessage{Type: "claim", ID: id, Nameplate: nameplate}, is[ClaimedMessage])
+}
+
+// Release gives up our claim on the nameplate, so it can be reused once
+// both sides are in the mailbox. The server answers with a ReleasedMessage.
+func (c *Client) Release(ctx context.Context, nameplate string) error {
+	id := randomID()
+	return c.call(ctx, id, ReleaseMessage{Type: "release", ID: id, Nameplate: nameplate}, is[ReleasedMessage])
 }
 
+// Open opens a mailbox. The server sends the messages it holds, and every
+// message added later, as MessageMessages.
+//
+// There is no reply to an open, and the server acks a request before
+// handling it, so Open follows it with a ping. The server handles requests
+// in order: once the pong is back, the mailbox is open, and an error opening
+// it would have come first.
 func (c *Client) Open(ctx context.Context, mailbox string) error {
-	return c.Write(ctx, OpenMessage{Type: "open", Mailbox: mailbox})
+	id := randomID()
+	c.mu.Lock()
+	c.pings++
+	n := c.pings
+	c.mu.Unlock()
+
+	cl := c.expect(id, func(ev interface{}) bool {
+		pong, ok := ev.(PongMessage)
+		return ok && pong.Pong == n
+	})
+	err := c.Write(ctx, OpenMessage{Type: "open", ID: id, Mailbox: mailbox})
+	if err == nil {
+		err = c.Write(ctx, PingMessage{Type: "ping", ID: randomID(), Ping: n})
+	}
+	if err != nil {
+		c.forget(cl)
+		return err
+	}
+	return c.wait(ctx, cl)
 }
 
+// CloseMailbox tells the server we are done with the mailbox. The mood
+// ("happy", "lonely", "scary" or "errory") is recorded by the server for
+// statistics. The server answers with a ClosedMessage.
+func (c *Client) CloseMailbox(ctx context.Context, mailbox, mood string) error {
+	id := randomID()
+	return c.call(ctx, id, CloseMessage{Type: "close", ID: id, Mailbox: mailbox, Mood: mood}, is[ClosedMessage])
+}
+
+// Ping asks the server to answer with a PongMessage carrying n, to check
+// that the connection is alive.
+func (c *Client) Ping(ctx context.Context, n int) error {
+	id := randomID()
+	return c.call(ctx, id, PingMessage{Type: "ping", ID: id, Ping: n}, func(ev interface{}) bool {
+		pong, ok := ev.(PongMessage)
+		return ok && pong.Pong == n
+	})
+}
+
+// Add adds a message to the open mailbox, and returns once the server sent
+// it back to us. The ID tells copies of it apart from other messages after
+// reconnecting.
 func (c *Client) Add(ctx context.Context, phase, body string) error {
-	return c.Write(ctx, AddMessage{
-		Type:  "add",
-		Phase: phase,
-		Body:  body,
+	id := randomID()
+	return c.call(ctx, id, AddMessage{Type: "add", ID: id, Phase: phase, Body: body}, func(ev interface{}) bool {
+		m, ok := ev.(MessageMessage)
+		return ok && m.Side == c.side && m.ID == id
 	})
 }
 
 func (c *Client) Close() {
 	c.closeOnce.Do(func() {
-		if c.conn != nil {
-			c.conn.Close(websocket.StatusNormalClosure, "bye")
+		c.mu.Lock()
+		close(c.done)
+		conn := c.conn
+		c.mu.Unlock()
+		if conn != nil {
+			conn.Close(websocket.StatusNormalClosure, "bye")
 		}
 	})
 }
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
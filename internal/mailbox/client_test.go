@@ -0,0 +1,112 @@
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestOpenError(t *testing.T) {
+	srv := NewServer()
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http") + "/v1"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A mailbox takes two sides; the third is turned away.
+	for i, side := range []string{"a", "b", "c"} {
+		c := NewClient(url, "test", side)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		err := c.Open(ctx, "mb")
+		var serverErr *ServerError
+		if i < 2 && err != nil {
+			t.Fatalf("side %s: %v", side, err)
+		}
+		if i == 2 {
+			if !errors.As(err, &serverErr) || serverErr.Request != "open" {
+				t.Fatalf("side %s: Open returned %v, want the server's error", side, err)
+			}
+			// The error went to Open, and other requests still work.
+			if err := c.List(ctx); err != nil {
+				t.Fatalf("List after the failed Open: %v", err)
+			}
+		}
+	}
+}
+
+func TestAllocateNotResent(t *testing.T) {
+	var mu sync.Mutex
+	var conns int
+	var after []string // request types on the connections after the first
+	var wg sync.WaitGroup
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		defer wg.Done()
+		defer conn.CloseNow()
+		mu.Lock()
+		conns++
+		first := conns == 1
+		mu.Unlock()
+
+		ctx := context.Background()
+		wsjson.Write(ctx, conn, map[string]interface{}{"type": "welcome", "welcome": map[string]string{}})
+		for {
+			var msg GenericInMessage
+			if err := wsjson.Read(ctx, conn, &msg); err != nil {
+				return
+			}
+			if first && msg.Type == "allocate" {
+				// Drop the connection before answering.
+				return
+			}
+			if !first {
+				mu.Lock()
+				after = append(after, msg.Type)
+				mu.Unlock()
+			}
+		}
+	}))
+	defer hs.Close()
+
+	c := NewClient("ws"+strings.TrimPrefix(hs.URL, "http")+"/v1", "test", "side")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Allocate(ctx); !errors.Is(err, ErrAllocationLost) {
+		t.Fatalf("Allocate returned %v, want ErrAllocationLost", err)
+	}
+	c.Close()
+	hs.Close()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns < 2 {
+		t.Fatal("the client did not reconnect")
+	}
+	for _, typ := range after {
+		if typ == "allocate" {
+			t.Fatalf("allocate sent again after reconnecting: %v", after)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package mailbox
 
+import "encoding/json"
+
 // Client-to-Server messages
 type genericOutMessage struct {
 	Type string `json:"type"`
@@ -7,10 +9,11 @@ type genericOutMessage struct {
 }
 
 type BindMessage struct {
-	Type  string `json:"type"`
-	ID    string `json:"id,omitempty"`
-	AppID string `json:"appid"`
-	Side  string `json:"side"`
+	Type          string   `json:"type"`
+	ID            string   `json:"id,omitempty"`
+	AppID         string   `json:"appid"`
+	Side          string   `json:"side"`
+	ClientVersion []string `json:"client_version,omitempty"`
 }
 
 type ListMessage struct {
@@ -69,11 +72,38 @@ type GenericInMessage struct {
 type WelcomeMessage struct {
 	Type    string `json:"type"`
 	Welcome struct {
-		MOTD              string `json:"motd"`
-		CurrentCLIUtility string `json:"current_cli_utility"`
+		MOTD              string `json:"motd,omitempty"`
+		CurrentCLIUtility string `json:"current_cli_utility,omitempty"`
 	} `json:"welcome"`
 }
 
+type AckMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+}
+
+type ErrorMessage struct {
+	Type  string          `json:"type"`
+	Error string          `json:"error"`
+	Orig  json.RawMessage `json:"orig,omitempty"`
+}
+
+// request returns the type and ID of the request the server rejected.
+func (m ErrorMessage) request() genericOutMessage {
+	var orig genericOutMessage
+	json.Unmarshal(m.Orig, &orig)
+	return orig
+}
+
+type NameplateInfo struct {
+	ID string `json:"id"`
+}
+
+type NameplatesMessage struct {
+	Type       string          `json:"type"`
+	Nameplates []NameplateInfo `json:"nameplates"`
+}
+
 type AllocatedMessage struct {
 	Type      string `json:"type"`
 	Nameplate string `json:"nameplate"`
@@ -84,10 +114,24 @@ type ClaimedMessage struct {
 	Mailbox string `json:"mailbox"`
 }
 
+type ReleasedMessage struct {
+	Type string `json:"type"`
+}
+
 type MessageMessage struct {
-	Type  string `json:"type"`
-	Side  string `json:"side"`
-	Phase string `json:"phase"`
-	ID    string `json:"id"`
-	Body  string `json:"body"`
+	Type     string  `json:"type"`
+	Side     string  `json:"side"`
+	Phase    string  `json:"phase"`
+	ID       string  `json:"id"`
+	Body     string  `json:"body"`
+	ServerRx float64 `json:"server_rx,omitempty"`
+}
+
+type ClosedMessage struct {
+	Type string `json:"type"`
+}
+
+type PongMessage struct {
+	Type string `json:"type"`
+	Pong int    `json:"pong"`
 }
@@ -0,0 +1,256 @@
+package mailbox
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const (
+	// minReconnectDelay and maxReconnectDelay bound the wait between
+	// attempts to reconnect, which doubles after each failure.
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+	// reconnectTimeout is how long the server may stay unreachable before
+	// the client gives up and closes EventChan.
+	reconnectTimeout = 10 * time.Minute
+	redialTimeout    = 10 * time.Second
+
+	// keepaliveInterval is how often the connection is pinged, so that one
+	// that died silently, e.g. forgotten by a NAT, is noticed and replaced.
+	keepaliveInterval = 30 * time.Second
+	keepaliveTimeout  = 10 * time.Second
+)
+
+// clientState is what the server knows about a client, to be restored on a
+// new connection, and the requests it has not answered yet.
+type clientState struct {
+	claim    ClaimMessage // the nameplate claimed, if any
+	claiming bool         // the claim is not answered yet
+	released bool
+	open     OpenMessage // the mailbox opened, if any
+	closed   bool        // the server confirmed closing the mailbox
+
+	pending []pendingRequest // requests not answered yet, oldest first
+	seen    map[string]bool  // messages delivered, by messageKey
+}
+
+// pendingRequest is a request the server has not answered yet.
+type pendingRequest struct {
+	v       interface{}
+	written bool // to a connection, so the server may have handled it
+}
+
+// sent records a request on its way to the server; written is false if it
+// waits for the client to reconnect.
+func (s *clientState) sent(v interface{}, written bool) {
+	switch v := v.(type) {
+	case ClaimMessage:
+		s.claim, s.claiming = v, true
+		return
+	case OpenMessage:
+		s.open = v
+		return
+	case ReleaseMessage:
+		s.released = true
+	}
+	s.pending = append(s.pending, pendingRequest{v: v, written: written})
+}
+
+// received records an event from the server and reports whether to deliver
+// it. Answers to requests that were only made to restore the state, and
+// messages the server replays after reconnecting, are dropped.
+func (s *clientState) received(ev interface{}, side string) bool {
+	switch ev := ev.(type) {
+	case ClaimedMessage:
+		if !s.claiming {
+			return false
+		}
+		s.claiming = false
+	case AllocatedMessage:
+		s.answered(func(v interface{}) bool { _, ok := v.(AllocateMessage); return ok })
+	case NameplatesMessage:
+		s.answered(func(v interface{}) bool { _, ok := v.(ListMessage); return ok })
+	case ReleasedMessage:
+		s.answered(func(v interface{}) bool { _, ok := v.(ReleaseMessage); return ok })
+	case ClosedMessage:
+		s.closed = true
+		s.answered(func(v interface{}) bool { _, ok := v.(CloseMessage); return ok })
+	case PongMessage:
+		s.answered(func(v interface{}) bool { p, ok := v.(PingMessage); return ok && p.Ping == ev.Pong })
+	case ErrorMessage:
+		orig := ev.request()
+		switch orig.Type {
+		case "claim":
+			s.claiming = false
+		case "open":
+			s.open = OpenMessage{}
+		}
+		s.answered(func(v interface{}) bool {
+			if orig.ID != "" {
+				return requestOf(v).ID == orig.ID
+			}
+			return requestOf(v).Type == orig.Type
+		})
+	case MessageMessage:
+		key := messageKey(ev)
+		if s.seen[key] {
+			return false
+		}
+		s.seen[key] = true
+		if ev.Side == side {
+			s.answered(func(v interface{}) bool { a, ok := v.(AddMessage); return ok && a.ID == ev.ID })
+		}
+	}
+	return true
+}
+
+// answered forgets the oldest pending request that match reports true for.
+func (s *clientState) answered(match func(v interface{}) bool) {
+	for i, p := range s.pending {
+		if match(p.v) {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// requestOf returns the type and ID of a request.
+func requestOf(v interface{}) genericOutMessage {
+	var generic genericOutMessage
+	if b, err := json.Marshal(v); err == nil {
+		json.Unmarshal(b, &generic)
+	}
+	return generic
+}
+
+// messageKey identifies a mailbox message. Clients give every message a
+// random ID; the content stands in for it if a client did not.
+func messageKey(m MessageMessage) string {
+	if m.ID != "" {
+		return m.Side + "/" + m.ID
+	}
+	return m.Side + "/" + m.Phase + "/" + m.Body
+}
+
+// reconnect replaces a broken connection, waiting longer after each failed
+// attempt. It returns nil once Close is called or the server has been
+// unreachable for reconnectTimeout.
+func (c *Client) reconnect() *websocket.Conn {
+	c.mu.Lock()
+	c.conn = nil
+	c.mu.Unlock()
+
+	deadline := time.Now().Add(reconnectTimeout)
+	delay := minReconnectDelay
+	for !c.isClosed() {
+		conn, err := c.redial()
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		select {
+		case <-time.After(delay + rand.N(delay/2)):
+		case <-c.done:
+			return nil
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+	return nil
+}
+
+// redial opens a new connection, claims our nameplate and opens our mailbox
+// again, and sends the requests the server has not answered. The server
+// replays the mailbox, and received drops what was delivered before.
+//
+// An allocation is not sent again if the server may have handled it: that
+// would allocate a second nameplate, and the answer naming the first is
+// lost. Its call fails with ErrAllocationLost instead.
+func (c *Client) redial() (*websocket.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redialTimeout)
+	defer cancel()
+	conn, _, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Writers wait until the state is restored, so nothing overtakes it.
+	// Requests keep their IDs, so that calls still waiting for them get
+	// their answer.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var restore []interface{}
+	if s := &c.state; s.claim.Nameplate != "" && !s.released {
+		restore = append(restore, s.claim)
+	}
+	if s := &c.state; s.open.Mailbox != "" && !s.closed {
+		restore = append(restore, s.open)
+	}
+	pending := c.state.pending[:0]
+	for _, p := range c.state.pending {
+		if a, ok := p.v.(AllocateMessage); ok && p.written {
+			c.fail(a.ID, ErrAllocationLost)
+			continue
+		}
+		pending = append(pending, p)
+	}
+	c.state.pending = pending
+
+	write := func(v interface{}) error {
+		err := wsjson.Write(ctx, conn, v)
+		if err != nil {
+			conn.Close(websocket.StatusInternalError, "")
+		}
+		return err
+	}
+	for _, v := range restore {
+		if err := write(v); err != nil {
+			return nil, err
+		}
+	}
+	for i := range pending {
+		pending[i].written = true
+		if err := write(pending[i].v); err != nil {
+			return nil, err
+		}
+	}
+	if c.isClosed() {
+		conn.Close(websocket.StatusNormalClosure, "bye")
+		return nil, ErrClosed
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// keepalive pings the server over conn until stop is called or a ping goes
+// unanswered, in which case conn is closed so that the read loop replaces it.
+func (c *Client) keepalive(conn *websocket.Conn) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pingCtx, pingCancel := context.WithTimeout(ctx, keepaliveTimeout)
+				err := conn.Ping(pingCtx)
+				pingCancel()
+				if err != nil {
+					if ctx.Err() == nil {
+						conn.Close(websocket.StatusGoingAway, "ping timeout")
+					}
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return cancel
+}
@@ -0,0 +1,534 @@
+package mailbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// DefaultMailboxTTL is how long an abandoned mailbox is kept before it expires.
+const DefaultMailboxTTL = 2 * time.Hour
+
+// maxMessageSize bounds a single WebSocket message in either direction.
+const maxMessageSize = 1 << 20
+
+// Server is a mailbox (rendezvous) server speaking the same protocol as Client.
+// It implements http.Handler, so it can be mounted on any mux or started
+// in-process with httptest.NewServer.
+type Server struct {
+	// MOTD is sent to every client in the welcome message.
+	MOTD string
+	// MailboxTTL is how long a mailbox without listeners is kept after its last
+	// activity. Zero means DefaultMailboxTTL.
+	MailboxTTL time.Duration
+
+	mu        sync.Mutex
+	apps      map[string]*serverApp
+	conns     map[*serverConn]struct{}
+	lastPrune time.Time
+}
+
+type serverApp struct {
+	nameplates map[string]*serverNameplate
+	mailboxes  map[string]*serverMailbox
+}
+
+type serverNameplate struct {
+	mailbox  string
+	claimed  map[string]bool // side -> still holding the claim
+	lastSeen time.Time
+}
+
+type serverMailbox struct {
+	opened    map[string]bool // side -> still open
+	messages  []MessageMessage
+	listeners map[*serverConn]struct{}
+	lastSeen  time.Time
+}
+
+// serverConn is the per-WebSocket state of a bound client.
+type serverConn struct {
+	conn *websocket.Conn
+	out  chan interface{}
+	done chan struct{}
+	once sync.Once
+
+	app       *serverApp
+	side      string
+	allocated bool
+	claimed   string
+	released  bool
+	mailbox   string
+	closed    bool
+}
+
+// protocolError is reported to the client as an "error" message.
+type protocolError string
+
+func (e protocolError) Error() string { return string(e) }
+
+// inMessage is the union of all client-to-server messages. Pointer fields
+// distinguish missing keys from empty values.
+type inMessage struct {
+	Type      string  `json:"type"`
+	ID        string  `json:"id"`
+	AppID     *string `json:"appid"`
+	Side      *string `json:"side"`
+	Nameplate *string `json:"nameplate"`
+	Mailbox   *string `json:"mailbox"`
+	Mood      string  `json:"mood"`
+	Phase     *string `json:"phase"`
+	Body      *string `json:"body"`
+	Ping      *int    `json:"ping"`
+}
+
+func NewServer() *Server {
+	return &Server{
+		MailboxTTL: DefaultMailboxTTL,
+		apps:       make(map[string]*serverApp),
+		conns:      make(map[*serverConn]struct{}),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn.SetReadLimit(maxMessageSize)
+
+	sc := &serverConn{
+		conn: conn,
+		out:  make(chan interface{}, 256),
+		done: make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.conns[sc] = struct{}{}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go sc.writeLoop(ctx)
+
+	welcome := WelcomeMessage{Type: "welcome"}
+	welcome.Welcome.MOTD = s.MOTD
+	sc.send(welcome)
+
+	for {
+		var raw json.RawMessage
+		if err := wsjson.Read(ctx, conn, &raw); err != nil {
+			break
+		}
+		s.handle(sc, raw)
+	}
+
+	s.disconnect(sc)
+	sc.shutdown(websocket.StatusNormalClosure, "")
+}
+
+// Close disconnects every client. The server stays usable afterwards.
+func (s *Server) Close() {
+	s.mu.Lock()
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+
+	for _, sc := range conns {
+		sc.shutdown(websocket.StatusGoingAway, "server shutting down")
+	}
+}
+
+func (sc *serverConn) writeLoop(ctx context.Context) {
+	for {
+		select {
+		case msg := <-sc.out:
+			if err := wsjson.Write(ctx, sc.conn, msg); err != nil {
+				sc.shutdown(websocket.StatusInternalError, "write failed")
+				return
+			}
+		case <-sc.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send queues msg for the client. A client that cannot keep up is dropped
+// rather than allowed to block the server.
+func (sc *serverConn) send(msg interface{}) {
+	select {
+	case sc.out <- msg:
+	case <-sc.done:
+	default:
+		sc.shutdown(websocket.StatusPolicyViolation, "too slow")
+	}
+}
+
+func (sc *serverConn) shutdown(code websocket.StatusCode, reason string) {
+	sc.once.Do(func() {
+		close(sc.done)
+		// The close handshake may wait on the peer; never block the caller,
+		// which can be holding the server lock.
+		go sc.conn.Close(code, reason)
+	})
+}
+
+func (s *Server) handle(sc *serverConn, raw json.RawMessage) {
+	now := time.Now()
+
+	var msg inMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		sc.send(ErrorMessage{Type: "error", Error: "invalid JSON", Orig: raw})
+		return
+	}
+	if msg.Type == "" {
+		sc.send(ErrorMessage{Type: "error", Error: "missing 'type'", Orig: raw})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+
+	sc.send(AckMessage{Type: "ack", ID: msg.ID})
+
+	var err error
+	switch msg.Type {
+	case "ping":
+		err = s.handlePing(sc, msg)
+	case "bind":
+		err = s.handleBind(sc, msg)
+	default:
+		if sc.app == nil {
+			err = protocolError("must bind first")
+			break
+		}
+		switch msg.Type {
+		case "list":
+			err = s.handleList(sc)
+		case "allocate":
+			err = s.handleAllocate(sc, now)
+		case "claim":
+			err = s.handleClaim(sc, msg, now)
+		case "release":
+			err = s.handleRelease(sc, msg)
+		case "open":
+			err = s.handleOpen(sc, msg, now)
+		case "add":
+			err = s.handleAdd(sc, msg, now)
+		case "close":
+			err = s.handleClose(sc, msg)
+		default:
+			err = protocolError("unknown type")
+		}
+	}
+
+	var perr protocolError
+	if errors.As(err, &perr) {
+		sc.send(ErrorMessage{Type: "error", Error: perr.Error(), Orig: raw})
+	}
+}
+
+func (s *Server) handlePing(sc *serverConn, msg inMessage) error {
+	if msg.Ping == nil {
+		return protocolError("ping requires 'ping'")
+	}
+	sc.send(PongMessage{Type: "pong", Pong: *msg.Ping})
+	return nil
+}
+
+func (s *Server) handleBind(sc *serverConn, msg inMessage) error {
+	if sc.app != nil {
+		return protocolError("already bound")
+	}
+	if msg.AppID == nil {
+		return protocolError("bind requires 'appid'")
+	}
+	if msg.Side == nil {
+		return protocolError("bind requires 'side'")
+	}
+
+	app, ok := s.apps[*msg.AppID]
+	if !ok {
+		app = &serverApp{
+			nameplates: make(map[string]*serverNameplate),
+			mailboxes:  make(map[string]*serverMailbox),
+		}
+		s.apps[*msg.AppID] = app
+	}
+	sc.app = app
+	sc.side = *msg.Side
+	return nil
+}
+
+func (s *Server) handleList(sc *serverConn) error {
+	list := NameplatesMessage{Type: "nameplates", Nameplates: []NameplateInfo{}}
+	for id := range sc.app.nameplates {
+		list.Nameplates = append(list.Nameplates, NameplateInfo{ID: id})
+	}
+	sc.send(list)
+	return nil
+}
+
+func (s *Server) handleAllocate(sc *serverConn, now time.Time) error {
+	if sc.allocated {
+		return protocolError("you already allocated one, don't be greedy")
+	}
+
+	// Hand out the smallest free number so that codes stay short.
+	var id string
+	for n := 1; ; n++ {
+		id = strconv.Itoa(n)
+		if _, taken := sc.app.nameplates[id]; !taken {
+			break
+		}
+	}
+	if _, err := s.claimNameplate(sc.app, id, sc.side, now); err != nil {
+		return err
+	}
+	sc.allocated = true
+	sc.send(AllocatedMessage{Type: "allocated", Nameplate: id})
+	return nil
+}
+
+func (s *Server) handleClaim(sc *serverConn, msg inMessage, now time.Time) error {
+	if msg.Nameplate == nil {
+		return protocolError("claim requires 'nameplate'")
+	}
+	if sc.claimed != "" {
+		return protocolError("only one claim per connection")
+	}
+
+	mailboxID, err := s.claimNameplate(sc.app, *msg.Nameplate, sc.side, now)
+	if err != nil {
+		return err
+	}
+	sc.claimed = *msg.Nameplate
+	sc.send(ClaimedMessage{Type: "claimed", Mailbox: mailboxID})
+	return nil
+}
+
+// claimNameplate records side as a claimant of nameplate id, creating the
+// nameplate and its mailbox on first use. At most two sides may claim it.
+func (s *Server) claimNameplate(app *serverApp, id, side string, now time.Time) (string, error) {
+	np, ok := app.nameplates[id]
+	if !ok {
+		np = &serverNameplate{
+			mailbox: randomMailboxID(),
+			claimed: make(map[string]bool),
+		}
+		app.nameplates[id] = np
+	}
+
+	if held, seen := np.claimed[side]; seen && !held {
+		return "", protocolError("reclaimed")
+	}
+	if _, seen := np.claimed[side]; !seen && len(np.claimed) >= 2 {
+		return "", protocolError("crowded")
+	}
+	np.claimed[side] = true
+	np.lastSeen = now
+	return np.mailbox, nil
+}
+
+func (s *Server) handleRelease(sc *serverConn, msg inMessage) error {
+	if sc.released {
+		return protocolError("only one release per connection")
+	}
+
+	id := sc.claimed
+	if msg.Nameplate != nil {
+		if id != "" && *msg.Nameplate != id {
+			return protocolError("release and claim must use same nameplate")
+		}
+		id = *msg.Nameplate
+	}
+	if id == "" {
+		return protocolError("release without nameplate must follow claim")
+	}
+
+	if np, ok := sc.app.nameplates[id]; ok {
+		if _, seen := np.claimed[sc.side]; seen {
+			np.claimed[sc.side] = false
+		}
+		if !anyHeld(np.claimed) {
+			delete(sc.app.nameplates, id)
+		}
+	}
+	sc.released = true
+	sc.send(ReleasedMessage{Type: "released"})
+	return nil
+}
+
+func (s *Server) handleOpen(sc *serverConn, msg inMessage, now time.Time) error {
+	if sc.mailbox != "" {
+		return protocolError("only one open per connection")
+	}
+	if msg.Mailbox == nil {
+		return protocolError("open requires 'mailbox'")
+	}
+
+	mb, ok := sc.app.mailboxes[*msg.Mailbox]
+	if !ok {
+		mb = &serverMailbox{
+			opened:    make(map[string]bool),
+			listeners: make(map[*serverConn]struct{}),
+		}
+		sc.app.mailboxes[*msg.Mailbox] = mb
+	}
+	if _, seen := mb.opened[sc.side]; !seen && len(mb.opened) >= 2 {
+		return protocolError("crowded")
+	}
+	mb.opened[sc.side] = true
+	mb.listeners[sc] = struct{}{}
+	mb.lastSeen = now
+	sc.mailbox = *msg.Mailbox
+
+	// Replay everything the mailbox already holds.
+	for _, m := range mb.messages {
+		sc.send(m)
+	}
+	return nil
+}
+
+func (s *Server) handleAdd(sc *serverConn, msg inMessage, now time.Time) error {
+	mb, ok := sc.app.mailboxes[sc.mailbox]
+	if sc.mailbox == "" || !ok {
+		return protocolError("must open mailbox before adding")
+	}
+	if msg.Phase == nil {
+		return protocolError("missing 'phase'")
+	}
+	if msg.Body == nil {
+		return protocolError("missing 'body'")
+	}
+
+	m := MessageMessage{
+		Type:     "message",
+		Side:     sc.side,
+		Phase:    *msg.Phase,
+		ID:       msg.ID,
+		Body:     *msg.Body,
+		ServerRx: float64(now.UnixNano()) / 1e9,
+	}
+	mb.messages = append(mb.messages, m)
+	mb.lastSeen = now
+	for l := range mb.listeners {
+		l.send(m)
+	}
+	return nil
+}
+
+func (s *Server) handleClose(sc *serverConn, msg inMessage) error {
+	if sc.closed {
+		return protocolError("only one close per connection")
+	}
+
+	id := sc.mailbox
+	if msg.Mailbox != nil {
+		if id != "" && *msg.Mailbox != id {
+			return protocolError("open and close must use same mailbox")
+		}
+		id = *msg.Mailbox
+	}
+	if id == "" {
+		return protocolError("close without mailbox must follow open")
+	}
+
+	if mb, ok := sc.app.mailboxes[id]; ok {
+		delete(mb.listeners, sc)
+		if _, seen := mb.opened[sc.side]; seen {
+			mb.opened[sc.side] = false
+		}
+		if !anyHeld(mb.opened) {
+			s.deleteMailbox(sc.app, id)
+		}
+	}
+	sc.mailbox = ""
+	sc.closed = true
+	sc.send(ClosedMessage{Type: "closed"})
+	return nil
+}
+
+// disconnect forgets sc. Its claims and open mailboxes are left in place so
+// the client may reconnect; abandoned ones are removed by pruneLocked.
+func (s *Server) disconnect(sc *serverConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, sc)
+	if sc.app == nil || sc.mailbox == "" {
+		return
+	}
+	if mb, ok := sc.app.mailboxes[sc.mailbox]; ok {
+		delete(mb.listeners, sc)
+		mb.lastSeen = time.Now()
+	}
+}
+
+// pruneLocked expires mailboxes that have had no listeners and no traffic
+// for MailboxTTL, along with their nameplates. It runs at most once a minute.
+func (s *Server) pruneLocked(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+
+	ttl := s.MailboxTTL
+	if ttl <= 0 {
+		ttl = DefaultMailboxTTL
+	}
+	for appID, app := range s.apps {
+		for id, mb := range app.mailboxes {
+			if len(mb.listeners) == 0 && now.Sub(mb.lastSeen) > ttl {
+				s.deleteMailbox(app, id)
+			}
+		}
+		for id, np := range app.nameplates {
+			if _, ok := app.mailboxes[np.mailbox]; !ok && now.Sub(np.lastSeen) > ttl {
+				delete(app.nameplates, id)
+			}
+		}
+		if len(app.nameplates) == 0 && len(app.mailboxes) == 0 {
+			delete(s.apps, appID)
+		}
+	}
+}
+
+// deleteMailbox removes a mailbox and any nameplate pointing at it.
+func (s *Server) deleteMailbox(app *serverApp, id string) {
+	delete(app.mailboxes, id)
+	for npID, np := range app.nameplates {
+		if np.mailbox == id {
+			delete(app.nameplates, npID)
+		}
+	}
+}
+
+func anyHeld(sides map[string]bool) bool {
+	for _, held := range sides {
+		if held {
+			return true
+		}
+	}
+	return false
+}
+
+func randomMailboxID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
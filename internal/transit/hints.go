@@ -0,0 +1,146 @@
+package transit
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Family is the address family of a direct hint. It is sent along with the
+// hint, so that a peer can tell the family of a host name too; for an
+// address, the address itself is what counts.
+type Family string
+
+const (
+	FamilyIPv4 Family = "ipv4"
+	FamilyIPv6 Family = "ipv6"
+	FamilyName Family = "" // a host name of unknown family, resolved when dialing
+)
+
+// Priorities of our direct hints; the peer tries higher ones first.
+const (
+	priorityDirect    = 1.0 // global, ULA and private addresses
+	priorityLinkLocal = 0.5 // only reachable from the same link
+)
+
+// family returns the address family of the hint's host: that of the
+// address, or for a host name the family the peer sent, if any.
+func (h Hint) family() Family {
+	ip, err := netip.ParseAddr(h.Hostname)
+	switch {
+	case err != nil:
+		return h.Family
+	case ip.Unmap().Is4():
+		return FamilyIPv4
+	default:
+		return FamilyIPv6
+	}
+}
+
+// directHints returns a hint for every address we can be reached at on
+// port: IPv4 and IPv6, global, ULA and private, and link-local with the
+// zone of the interface. Loopback addresses and interfaces that are down are
+// left out.
+func directHints(port int) ([]Hint, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var hints []Hint
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipnet.IP)
+			if !ok {
+				continue
+			}
+			ip = ip.Unmap()
+			if ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() {
+				continue
+			}
+			priority := priorityDirect
+			if ip.IsLinkLocalUnicast() {
+				priority = priorityLinkLocal
+				if ip.Is6() {
+					ip = ip.WithZone(iface.Name)
+				}
+			}
+			family := FamilyIPv4
+			if ip.Is6() {
+				family = FamilyIPv6
+			}
+			hints = append(hints, Hint{Type: HintDirectTCP, Priority: priority, Family: family, Hostname: ip.String(), Port: port})
+		}
+	}
+	return hints, nil
+}
+
+// orderHints sorts direct hints by priority. Hints of equal priority
+// alternate between IPv6 and IPv4, starting with IPv6, as Happy Eyeballs
+// (RFC 8305) does, so that a family that does not work holds up every other
+// attempt at most.
+func orderHints(hints []Hint) []Hint {
+	sorted := append([]Hint(nil), hints...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority > sorted[j].Priority })
+
+	ordered := make([]Hint, 0, len(sorted))
+	for len(sorted) > 0 {
+		n := 1
+		for n < len(sorted) && sorted[n].Priority == sorted[0].Priority {
+			n++
+		}
+		var v6, other []Hint
+		for _, h := range sorted[:n] {
+			if h.family() == FamilyIPv6 {
+				v6 = append(v6, h)
+			} else {
+				other = append(other, h)
+			}
+		}
+		for len(v6) > 0 || len(other) > 0 {
+			if len(v6) > 0 {
+				ordered, v6 = append(ordered, v6[0]), v6[1:]
+			}
+			if len(other) > 0 {
+				ordered, other = append(ordered, other[0]), other[1:]
+			}
+		}
+		sorted = sorted[n:]
+	}
+	return ordered
+}
+
+// dialAddrs returns the addresses to dial for a direct hint. The zone of a
+// link-local IPv6 address names an interface of the peer, which tells us
+// nothing about ours even when one has the same name, so the address is
+// tried on each of our interfaces that has a link-local address.
+func dialAddrs(h Hint) []string {
+	host, _, _ := strings.Cut(h.Hostname, "%")
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !ip.Is6() || !ip.IsLinkLocalUnicast() {
+		return []string{h.addr()}
+	}
+
+	var addrs []string
+	zones := make(map[string]bool)
+	ours, _ := directHints(h.Port)
+	for _, o := range ours {
+		oip, err := netip.ParseAddr(o.Hostname)
+		if err == nil && oip.Is6() && oip.IsLinkLocalUnicast() && !zones[oip.Zone()] {
+			zones[oip.Zone()] = true
+			addrs = append(addrs, Hint{Hostname: ip.WithZone(oip.Zone()).String(), Port: h.Port}.addr())
+		}
+	}
+	return addrs
+}
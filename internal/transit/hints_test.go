@@ -0,0 +1,85 @@
+package transit
+
+import (
+	"encoding/json"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestHintFamily(t *testing.T) {
+	var hints []Hint
+	err := json.Unmarshal([]byte(`[
+		{"type": "direct-tcp-v1", "priority": 1, "family": "ipv4", "hostname": "host4.example", "port": 1},
+		{"type": "direct-tcp-v1", "priority": 1, "family": "ipv4", "hostname": "2001:db8::1", "port": 2},
+		{"type": "direct-tcp-v1", "priority": 1, "family": "ipv6", "hostname": "host6.example", "port": 3},
+		{"type": "direct-tcp-v1", "priority": 1, "hostname": "192.0.2.1", "port": 4}
+	]`), &hints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The family sent counts for host names; an address speaks for itself.
+	want := []Family{FamilyIPv4, FamilyIPv6, FamilyIPv6, FamilyIPv4}
+	for i, h := range hints {
+		if got := h.family(); got != want[i] {
+			t.Errorf("hint %s: family %q, want %q", h.Hostname, got, want[i])
+		}
+	}
+
+	var ports []int
+	for _, h := range orderHints(hints) {
+		ports = append(ports, h.Port)
+	}
+	if want := []int{2, 1, 3, 4}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("ordered ports %v, want %v", ports, want)
+	}
+}
+
+func TestDirectHintsFamily(t *testing.T) {
+	hints, err := directHints(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hints {
+		if h.Family == FamilyName || h.Family != h.family() {
+			t.Errorf("hint %s sent with family %q", h.Hostname, h.Family)
+		}
+	}
+}
+
+func TestDialAddrsLinkLocal(t *testing.T) {
+	var zones []string
+	ours, _ := directHints(1)
+	for _, o := range ours {
+		if ip, err := netip.ParseAddr(o.Hostname); err == nil && ip.Is6() && ip.IsLinkLocalUnicast() && !slices.Contains(zones, ip.Zone()) {
+			zones = append(zones, ip.Zone())
+		}
+	}
+	if len(zones) == 0 {
+		t.Skip("no interface with a link-local address")
+	}
+
+	// Whatever the peer's interface is called, even if one of ours has
+	// the same name, the address is tried on each of ours.
+	for _, peerZone := range []string{"", zones[0], "peer0"} {
+		host := "fe80::1"
+		if peerZone != "" {
+			host += "%" + peerZone
+		}
+		var want []string
+		for _, z := range zones {
+			want = append(want, net.JoinHostPort("fe80::1%"+z, "4001"))
+		}
+		got := dialAddrs(Hint{Type: HintDirectTCP, Hostname: host, Port: 4001})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("hint %s: dialing %v, want %v", host, got, want)
+		}
+	}
+
+	if got := dialAddrs(Hint{Type: HintDirectTCP, Hostname: "192.0.2.1", Port: 4001}); !reflect.DeepEqual(got, []string{"192.0.2.1:4001"}) {
+		t.Errorf("dialing %v for an IPv4 hint", got)
+	}
+}
@@ -0,0 +1,226 @@
+package transit
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relayPairTimeout bounds how long a client waits for the relay to pair it
+// with its peer.
+const relayPairTimeout = 30 * time.Second
+
+// DefaultRelayPendingTimeout is how long the relay keeps an unpaired client.
+const DefaultRelayPendingTimeout = 2 * time.Minute
+
+// RelayServer pairs two transit clients presenting the same token and copies
+// bytes between them. It never sees plaintext: everything it forwards is
+// encrypted with the session key.
+type RelayServer struct {
+	// PendingTimeout is how long an unpaired client waits for its peer.
+	// Zero means DefaultRelayPendingTimeout.
+	PendingTimeout time.Duration
+
+	mu       sync.Mutex
+	pending  map[string][]*relayClient
+	conns    map[net.Conn]struct{}
+	listener net.Listener
+	closed   bool
+}
+
+type relayClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	side   string
+	paired chan *relayClient
+}
+
+func NewRelayServer() *RelayServer {
+	return &RelayServer{
+		PendingTimeout: DefaultRelayPendingTimeout,
+		pending:        make(map[string][]*relayClient),
+		conns:          make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts relay clients on l until l is closed or Close is called.
+func (s *RelayServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting clients and drops every pending and paired connection.
+func (s *RelayServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *RelayServer) handle(conn net.Conn) {
+	if !s.track(conn) {
+		conn.Close()
+		return
+	}
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(relayPairTimeout))
+	r := bufio.NewReader(conn)
+	token, side, err := readRelayRequest(r)
+	if err != nil {
+		io.WriteString(conn, "bad handshake\n")
+		return
+	}
+
+	me := &relayClient{conn: conn, reader: r, side: side, paired: make(chan *relayClient, 1)}
+	peer := s.pair(token, me)
+	if peer == nil {
+		timeout := s.PendingTimeout
+		if timeout <= 0 {
+			timeout = DefaultRelayPendingTimeout
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		select {
+		case <-me.paired:
+			// The peer's goroutine owns the splice; wait for it to finish.
+			<-me.paired
+		case <-time.After(timeout):
+			s.unpend(token, me)
+		}
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	peer.conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "ok\n"); err == nil {
+		if _, err := io.WriteString(peer.conn, "ok\n"); err == nil {
+			splice(me, peer)
+		}
+	}
+	close(peer.paired)
+}
+
+// pair returns a pending client with the same token and another side, or
+// registers c as pending and returns nil.
+func (s *RelayServer) pair(token string, c *relayClient) *relayClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waiting := s.pending[token]
+	for i, other := range waiting {
+		if other.side != c.side || c.side == "" {
+			s.pending[token] = append(waiting[:i:i], waiting[i+1:]...)
+			if len(s.pending[token]) == 0 {
+				delete(s.pending, token)
+			}
+			other.paired <- c
+			return other
+		}
+	}
+	s.pending[token] = append(waiting, c)
+	return nil
+}
+
+func (s *RelayServer) unpend(token string, c *relayClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waiting := s.pending[token]
+	for i, other := range waiting {
+		if other == c {
+			s.pending[token] = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(s.pending[token]) == 0 {
+		delete(s.pending, token)
+	}
+}
+
+func (s *RelayServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *RelayServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// readRelayRequest parses "please relay TOKEN for side SIDE\n". The side is
+// optional for compatibility with older clients.
+func readRelayRequest(r *bufio.Reader) (token, side string, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	if len(line) > 256 {
+		return "", "", errors.New("request too long")
+	}
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "please" && fields[1] == "relay":
+		return fields[2], "", nil
+	case len(fields) == 6 && fields[0] == "please" && fields[1] == "relay" &&
+		fields[3] == "for" && fields[4] == "side":
+		return fields[2], fields[5], nil
+	}
+	return "", "", errors.New("malformed relay request")
+}
+
+// splice copies bytes in both directions until both sides are done.
+func splice(a, b *relayClient) {
+	var wg sync.WaitGroup
+	pipe := func(dst, src *relayClient) {
+		defer wg.Done()
+		io.Copy(dst.conn, src.reader)
+		if tcp, ok := dst.conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.conn.Close()
+		}
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+}
@@ -3,172 +3,626 @@ package transit
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/frostbyte57/GoPipe/internal/crypto"
 )
 
+// Metadata describes what the sender offers, as shown to the receiver.
 type Metadata struct {
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-	Mode string `json:"mode"` // "file" or "dir"
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`               // bytes on the wire, -1 for a stream of unknown size
+	Mode    string `json:"mode"`               // "file", "dir", "multi" for several, "text" for a message, or "session"
+	Archive string `json:"archive,omitempty"`  // how a directory is packed
+	Files   int    `json:"files,omitempty"`    // number of files in a directory
+	RawSize int64  `json:"raw_size,omitempty"` // uncompressed size of a directory
+
+	ContentID string `json:"content_id,omitempty"` // identifies a file across sessions, for resuming
+
+	Entries []Entry `json:"entries,omitempty"` // what a "multi" offer contains
+}
+
+// Entry is one of the files or directories of a "multi" offer.
+type Entry struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`            // bytes of the files in it
+	Mode  string `json:"mode"`            // "file" or "dir"
+	Files int    `json:"files,omitempty"` // number of files in a directory
+}
+
+// DefaultRelay is the transit relay used when direct connections fail.
+const DefaultRelay = "transit.magic-wormhole.io:4001"
+
+// Hint types understood by magic-wormhole clients.
+const (
+	HintDirectTCP = "direct-tcp-v1"
+	HintRelay     = "relay-v1"
+)
+
+// handshakeTimeout bounds the transit handshake when ctx has no deadline.
+const handshakeTimeout = 30 * time.Second
+
+// Abilities lists the connection types we support, as advertised to the peer.
+var Abilities = []Ability{{Type: HintDirectTCP}, {Type: HintRelay}}
+
+type Ability struct {
+	Type string `json:"type"`
 }
 
+// Hint tells the peer how it may reach us. Relay hints carry the addresses
+// of the relay in Hints. The peer tries direct hints of higher Priority
+// first; Family tells IPv4 from IPv6 ones. Other clients neither send nor
+// read Family.
+type Hint struct {
+	Type     string  `json:"type"`
+	Priority float64 `json:"priority"`
+	Family   Family  `json:"family,omitempty"`
+	Hostname string  `json:"hostname,omitempty"`
+	Port     int     `json:"port,omitempty"`
+	Hints    []Hint  `json:"hints,omitempty"`
+}
+
+func (h Hint) addr() string {
+	return net.JoinHostPort(h.Hostname, strconv.Itoa(h.Port))
+}
+
+// TransitMessage is the "transit" entry of the application message that
+// exchanges connection hints.
+type TransitMessage struct {
+	Abilities []Ability `json:"abilities-v1"`
+	Hints     []Hint    `json:"hints-v1"`
+}
+
+// candidateTimeout bounds the handshake on a single candidate connection.
+const candidateTimeout = 10 * time.Second
+
+// errLostRace is returned for a candidate that passed the handshake after
+// another one was already chosen.
+var errLostRace = errors.New("another connection was chosen")
+
 // Transit handles the data connection.
+//
+// Every connection that may lead to the peer, whether accepted, dialed or
+// relayed, is a candidate. A candidate is only used once it has passed the
+// handshake, which proves knowledge of the transit key; the first one to
+// pass wins and all others are closed.
 type Transit struct {
-	sessionKey []byte
+	key        []byte // transit key, derived from the session key
+	isSender   bool
+	side       string
+	relay      string
 	listener   net.Listener
-	conn       net.Conn
-	localHints []string
-}
+	localHints []Hint
 
-type TransitMessage struct {
-	Hints []string `json:"hints"`
+	// ctx bounds the handshakes of accepted candidates; cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	conn      net.Conn      // the winning candidate
+	connected chan struct{} // closed once conn is set
+	lastErr   error         // why the most recent candidate was rejected
 }
 
-func NewTransit(sessionKey []byte) *Transit {
+// NewTransit creates a Transit for the given transit key. isSender selects
+// our role in the handshake, and relay is the address of a transit relay to
+// fall back to, or empty to disable relaying.
+func NewTransit(transitKey []byte, isSender bool, relay string) *Transit {
+	b, _ := crypto.RandomBytes(8)
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Transit{
-		sessionKey: sessionKey,
+		key:       transitKey,
+		isSender:  isSender,
+		side:      hex.EncodeToString(b),
+		relay:     relay,
+		ctx:       ctx,
+		cancel:    cancel,
+		connected: make(chan struct{}),
 	}
 }
 
-func (t *Transit) Start() ([]string, error) {
-	l, err := net.Listen("tcp", "0.0.0.0:0")
+// Start listens for incoming connections, on IPv4 and IPv6 where the system
+// supports both, and returns the hints to send to the peer: one per local
+// address, plus our relay.
+func (t *Transit) Start() ([]Hint, error) {
+	l, err := net.Listen("tcp", ":0")
 	if err != nil {
 		return nil, err
 	}
 	t.listener = l
 
-	// Get local IPs
-	addrs, err := net.InterfaceAddrs()
+	hints, err := directHints(l.Addr().(*net.TCPAddr).Port)
 	if err != nil {
+		l.Close()
 		return nil, err
 	}
 
-	port := l.Addr().(*net.TCPAddr).Port
-	var hints []string
-
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				hints = append(hints, fmt.Sprintf("%s:%d", ipnet.IP.String(), port))
-			}
+	if t.relay != "" {
+		relayHint, err := parseRelay(t.relay)
+		if err != nil {
+			return nil, err
 		}
+		hints = append(hints, relayHint)
 	}
+	t.localHints = hints
+
 	go t.acceptLoop()
 
 	return hints, nil
 }
 
+func parseRelay(addr string) (Hint, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Hint{}, fmt.Errorf("invalid relay address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Hint{}, fmt.Errorf("invalid relay port %q", portStr)
+	}
+	return Hint{
+		Type:  HintRelay,
+		Hints: []Hint{{Type: HintDirectTCP, Hostname: host, Port: port}},
+	}, nil
+}
+
+// acceptLoop hands every incoming connection to tryCandidate. It keeps
+// listening until a candidate wins, so a stranger connecting first cannot
+// lock the peer out.
 func (t *Transit) acceptLoop() {
 	for {
 		conn, err := t.listener.Accept()
 		if err != nil {
 			return
 		}
+		go t.tryCandidate(t.ctx, conn)
+	}
+}
+
+// tryCandidate runs the handshake on conn and makes it the transit
+// connection if no other candidate won before. Candidates that fail the
+// handshake or lose the race are closed.
+func (t *Transit) tryCandidate(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, candidateTimeout)
+	defer cancel()
+
+	tuneConn(conn)
+	if err := t.handshake(ctx, conn); err != nil {
+		conn.Close()
+		t.mu.Lock()
+		t.lastErr = err
+		t.mu.Unlock()
+		return err
+	}
 
-		if tcpConn, ok := conn.(*net.TCPConn); ok {
-			_ = tcpConn.SetReadBuffer(4 * 1024 * 1024)
-			_ = tcpConn.SetWriteBuffer(4 * 1024 * 1024)
-			_ = tcpConn.SetNoDelay(true)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		if t.isSender {
+			io.WriteString(conn, "nevermind\n")
 		}
+		conn.Close()
+		return errLostRace
+	}
+	if t.isSender {
+		// The receiver waits for our decision before using the connection.
+		if _, err := io.WriteString(conn, "go\n"); err != nil {
+			conn.Close()
+			t.lastErr = err
+			return err
+		}
+	}
 
-		t.conn = conn
+	t.conn = conn
+	close(t.connected)
+	if t.listener != nil {
 		t.listener.Close()
 	}
+	return nil
 }
 
-func (t *Transit) ConnectToPeer(ctx context.Context, hints []string) error {
+// winner returns the chosen connection, or nil.
+func (t *Transit) winner() net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn
+}
 
-	if t.conn != nil {
+// failure describes why no candidate has won so far.
+func (t *Transit) failure(fallback string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastErr != nil {
+		return fmt.Errorf("%s (last candidate: %w)", fallback, t.lastErr)
+	}
+	return errors.New(fallback)
+}
+
+const (
+	// dialStagger is how long a connection attempt runs on its own before
+	// the next one is started alongside it, as in Happy Eyeballs (RFC 8305).
+	// An attempt that fails starts the next one right away.
+	dialStagger = 250 * time.Millisecond
+	// relayDelay holds the relays back while direct attempts are running,
+	// so that a direct connection is used whenever one works.
+	relayDelay = 2 * time.Second
+)
+
+// route is a way to reach the peer, tried by ConnectToPeer.
+type route struct {
+	desc  string        // e.g. "192.168.1.7:4312" or "relay relay.example:4001"
+	after time.Duration // not started earlier while direct attempts run
+	dial  func(ctx context.Context) (net.Conn, error)
+}
+
+// ConnectToPeer races connections to all the peer's hints, and to the
+// relays, both our own and those advertised by the peer, against the peer
+// connecting to us. The attempts start one after another, each dialStagger
+// after the previous one or as soon as it failed; relays wait relayDelay
+// for the direct attempts. The first candidate to pass the handshake wins,
+// and the attempts still running are cancelled.
+//
+// Even once every attempt has failed, the peer may still connect to us, so
+// ConnectToPeer only gives up when ctx is done: give it a deadline.
+func (t *Transit) ConnectToPeer(ctx context.Context, hints []Hint) error {
+	var direct, relays []Hint
+	for _, h := range t.localHints {
+		if h.Type == HintRelay {
+			relays = append(relays, relayHints(h)...)
+		}
+	}
+	for _, h := range hints {
+		switch h.Type {
+		case HintDirectTCP:
+			direct = append(direct, h)
+		case HintRelay:
+			relays = append(relays, relayHints(h)...)
+		}
+	}
+
+	var routes []route
+	for _, h := range orderHints(direct) {
+		for _, addr := range dialAddrs(h) {
+			routes = append(routes, route{desc: addr, dial: func(ctx context.Context) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", addr)
+			}})
+		}
+	}
+	for _, h := range mergeRelays(relays) {
+		addr := h.addr()
+		routes = append(routes, route{desc: "relay " + addr, after: relayDelay, dial: func(ctx context.Context) (net.Conn, error) {
+			return t.connectRelay(ctx, addr)
+		}})
+	}
+	return t.race(ctx, routes)
+}
+
+// relayHints returns the addresses of the relay a relay hint points to.
+func relayHints(h Hint) []Hint {
+	var addrs []Hint
+	for _, rh := range h.Hints {
+		if rh.Type == HintDirectTCP {
+			addrs = append(addrs, rh)
+		}
+	}
+	return addrs
+}
+
+// race runs the attempts on routes, staggered, until a candidate wins or
+// ctx is done. Returning cancels the attempts still running; tryCandidate
+// closes those that get through anyway.
+func (t *Transit) race(ctx context.Context, routes []route) error {
+	if t.winner() != nil {
 		return nil
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	for _, hint := range hints {
-		d := net.Dialer{Timeout: 2 * time.Second}
-		conn, err := d.DialContext(ctx, "tcp", hint)
-		if err == nil {
-			// Tune TCP connection
-			if tcpConn, ok := conn.(*net.TCPConn); ok {
-				_ = tcpConn.SetReadBuffer(4 * 1024 * 1024)
-				_ = tcpConn.SetWriteBuffer(4 * 1024 * 1024)
-				_ = tcpConn.SetNoDelay(true)
+	begin := time.Now()
+	failed := make(chan struct{}, len(routes))
+	running := 0
+	next := 0
+	launch := func() {
+		r := routes[next]
+		next++
+		running++
+		go func() {
+			conn, err := r.dial(ctx)
+			if err == nil {
+				err = t.tryCandidate(ctx, conn)
+			} else if ctx.Err() == nil {
+				t.mu.Lock()
+				t.lastErr = fmt.Errorf("%s: %w", r.desc, err)
+				t.mu.Unlock()
 			}
-			t.conn = conn
-			if t.listener != nil {
-				t.listener.Close()
+			if err != nil {
+				failed <- struct{}{}
 			}
-			return nil
+		}()
+	}
+	// hold is how long the next attempt has to wait for the direct ones.
+	hold := func() time.Duration {
+		if running == 0 {
+			return 0
 		}
+		return max(0, routes[next].after-time.Since(begin))
 	}
 
-	timeout := time.After(5 * time.Second)
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
-
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 	for {
+		var tick <-chan time.Time
+		if next < len(routes) {
+			tick = timer.C
+		}
 		select {
+		case <-t.connected:
+			return nil
+		case <-tick:
+			launch()
+			if next < len(routes) {
+				timer.Reset(max(dialStagger, hold()))
+			}
+		case <-failed:
+			running--
+			if next < len(routes) {
+				// Start the next attempt now, unless it has to wait for
+				// the direct ones still running.
+				timer.Reset(hold())
+			}
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-timeout:
-			return fmt.Errorf("failed to connect to hints and no incoming connection")
-		case <-ticker.C:
-			if t.conn != nil {
+			if t.winner() != nil {
 				return nil
 			}
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return t.failure("no connection to the peer")
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// connectRelay asks the relay at addr to pair us with the peer. Both sides
+// present the same token, derived from the transit key, and the relay joins
+// the two connections once it has seen both.
+func (t *Transit) connectRelay(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	token := crypto.DeriveKey(t.key, nil, "transit_relay_token")
+	if _, err := fmt.Fprintf(conn, "please relay %s for side %s\n", hex.EncodeToString(token), t.side); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Read byte by byte: anything after "ok\n" already belongs to the peer.
+	reply := make([]byte, 0, 16)
+	b := make([]byte, 1)
+	for len(reply) < cap(reply) {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("waiting for peer: %w", err)
+		}
+		reply = append(reply, b[0])
+		if b[0] == '\n' {
+			break
+		}
+	}
+	if string(reply) != "ok\n" {
+		conn.Close()
+		return nil, fmt.Errorf("relay refused: %q", strings.TrimSpace(string(reply)))
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// handshake proves to each other that both ends know the transit key. Each
+// side sends a role-specific string derived from the key and checks the one
+// it receives. The receiver then waits for the sender to pick this
+// connection with "go"; the sender's decision is made by tryCandidate.
+func (t *Transit) handshake(ctx context.Context, conn net.Conn) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	senderHS := fmt.Sprintf("transit sender %s ready\n\n",
+		hex.EncodeToString(crypto.DeriveKey(t.key, nil, "transit_sender")))
+	receiverHS := fmt.Sprintf("transit receiver %s ready\n\n",
+		hex.EncodeToString(crypto.DeriveKey(t.key, nil, "transit_receiver")))
+
+	ours, theirs := receiverHS, senderHS
+	if t.isSender {
+		ours, theirs = senderHS, receiverHS
+	}
+
+	if _, err := io.WriteString(conn, ours); err != nil {
+		return err
+	}
+	got := make([]byte, len(theirs))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("transit handshake: %w", err)
+	}
+	if subtle.ConstantTimeCompare(got, []byte(theirs)) != 1 {
+		return fmt.Errorf("transit handshake: peer does not know the key")
+	}
+
+	if t.isSender {
+		return nil
+	}
+	decision := make([]byte, 3)
+	if _, err := io.ReadFull(conn, decision); err != nil {
+		return fmt.Errorf("transit handshake: %w", err)
+	}
+	if string(decision) != "go\n" {
+		return errLostRace
+	}
+	return nil
+}
+
+// mergeRelays drops relay addresses that were seen before.
+func mergeRelays(relays []Hint) []Hint {
+	seen := make(map[string]bool)
+	var merged []Hint
+	for _, r := range relays {
+		if addr := r.addr(); r.Hostname != "" && !seen[addr] {
+			seen[addr] = true
+			merged = append(merged, r)
 		}
 	}
+	return merged
+}
+
+func tuneConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetReadBuffer(4 * 1024 * 1024)
+		_ = tcpConn.SetWriteBuffer(4 * 1024 * 1024)
+		_ = tcpConn.SetNoDelay(true)
+	}
 }
 
-func (t *Transit) SecureConnection() (io.ReadWriteCloser, error) {
-	if t.conn == nil {
+// Close stops listening for the peer. An established connection is owned by
+// the EncryptedConn and closed through it.
+func (t *Transit) Close() error {
+	t.cancel()
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
+
+// SecureConnection wraps the established connection in the record layer.
+func (t *Transit) SecureConnection() (*EncryptedConn, error) {
+	conn := t.winner()
+	if conn == nil {
 		return nil, fmt.Errorf("no connection")
 	}
+
+	senderKey := crypto.DeriveKey(t.key, nil, "transit_record_sender_key")
+	receiverKey := crypto.DeriveKey(t.key, nil, "transit_record_receiver_key")
+	sendKey, recvKey := receiverKey, senderKey
+	if t.isSender {
+		sendKey, recvKey = senderKey, receiverKey
+	}
+
 	return &EncryptedConn{
-		conn:      t.conn,
-		key:       t.sessionKey,
-		msgReader: bufio.NewReaderSize(t.conn, 64*1024*1024),
-		msgWriter: bufio.NewWriterSize(t.conn, 64*1024*1024),
+		conn:      conn,
+		sendKey:   sendKey,
+		recvKey:   recvKey,
+		msgReader: bufio.NewReaderSize(conn, 64*1024*1024),
+		msgWriter: bufio.NewWriterSize(conn, 64*1024*1024),
 	}, nil
 }
 
+// EncryptedConn is the record layer of a transit connection. Every Write is
+// sent as one record: a 4-byte big-endian length followed by a secretbox
+// whose nonce is the record's sequence number. Each direction has its own
+// key and sequence, so records cannot be replayed, reordered or reflected.
+//
+// CloseWrite sends an empty record that marks the end of the stream. Read
+// only reports io.EOF after that record; a connection that simply ends is
+// reported as truncated.
 type EncryptedConn struct {
-	conn net.Conn
-	key  []byte
-	buf  []byte // read buffer for decrypted data (leftover)
+	conn    net.Conn
+	sendKey []byte
+	recvKey []byte
+	sendSeq uint64
+	recvSeq uint64
+	buf     []byte // read buffer for decrypted data (leftover)
+	eofSent bool
+	eofRecv bool
 
 	msgReader *bufio.Reader
 	msgWriter *bufio.Writer
 }
 
+func seqNonce(seq uint64) [24]byte {
+	var nonce [24]byte
+	binary.BigEndian.PutUint64(nonce[16:], seq)
+	return nonce
+}
+
+// ErrTruncated is returned when the connection ends without an
+// end-of-stream record.
+var ErrTruncated = fmt.Errorf("transit stream truncated: %w", io.ErrUnexpectedEOF)
+
 func (ec *EncryptedConn) Write(p []byte) (n int, err error) {
-	// Encrypt chunk
-	encrypted, err := crypto.Encrypt(ec.key, p)
-	if err != nil {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := ec.WriteRecord(p); err != nil {
 		return 0, err
 	}
-	// Send Length (4 bytes) + Content
-	length := uint32(len(encrypted))
+	return len(p), nil
+}
+
+// WriteRecord encrypts p and sends it as a single record. p must not be
+// empty, since an empty record marks the end of the stream.
+func (ec *EncryptedConn) WriteRecord(p []byte) error {
+	if len(p) == 0 {
+		return fmt.Errorf("empty record")
+	}
+	return ec.writeRecord(p)
+}
+
+// CloseWrite sends the end-of-stream record. The connection stays open for
+// reading; further writes fail.
+func (ec *EncryptedConn) CloseWrite() error {
+	if ec.eofSent {
+		return nil
+	}
+	if err := ec.writeRecord(nil); err != nil {
+		return err
+	}
+	ec.eofSent = true
+	return nil
+}
+
+func (ec *EncryptedConn) writeRecord(p []byte) error {
+	if ec.eofSent {
+		return fmt.Errorf("write after end of stream")
+	}
+	encrypted, err := crypto.EncryptWithNonce(ec.sendKey, seqNonce(ec.sendSeq), p)
+	if err != nil {
+		return err
+	}
+	ec.sendSeq++
+
 	header := make([]byte, 4)
-	header[0] = byte(length >> 24)
-	header[1] = byte(length >> 16)
-	header[2] = byte(length >> 8)
-	header[3] = byte(length)
+	binary.BigEndian.PutUint32(header, uint32(len(encrypted)))
 
-	// Write to buffer
 	if _, err := ec.msgWriter.Write(header); err != nil {
-		return 0, err
+		return err
 	}
 	if _, err := ec.msgWriter.Write(encrypted); err != nil {
-		return 0, err
-	}
-	if err := ec.msgWriter.Flush(); err != nil {
-		return 0, err
+		return err
 	}
-	return len(p), nil
+	return ec.msgWriter.Flush()
 }
 
 func (ec *EncryptedConn) Read(p []byte) (n int, err error) {
@@ -179,32 +633,69 @@ func (ec *EncryptedConn) Read(p []byte) (n int, err error) {
 		return copyLen, nil
 	}
 
-	// Read Header
+	decrypted, err := ec.ReadRecord()
+	if err != nil {
+		return 0, err
+	}
+
+	copyLen := copy(p, decrypted)
+	if copyLen < len(decrypted) {
+		ec.buf = decrypted[copyLen:]
+	}
+	return copyLen, nil
+}
+
+// ReadRecord reads and decrypts the next record. It returns io.EOF once the
+// peer has sent the end-of-stream record. It must not be mixed with a
+// partially consumed Read.
+func (ec *EncryptedConn) ReadRecord() ([]byte, error) {
+	if len(ec.buf) > 0 {
+		return nil, fmt.Errorf("unread data before record")
+	}
+	if ec.eofRecv {
+		return nil, io.EOF
+	}
+
 	header := make([]byte, 4)
 	if _, err := io.ReadFull(ec.msgReader, header); err != nil {
-		return 0, err
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
 	}
-	length := uint32(header[0])<<24 | uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+	length := binary.BigEndian.Uint32(header)
 
 	if length > 100*1024*1024 { // 100MB chunk max
-		return 0, fmt.Errorf("chunk too large")
+		return nil, fmt.Errorf("chunk too large")
 	}
 
 	encrypted := make([]byte, length)
 	if _, err := io.ReadFull(ec.msgReader, encrypted); err != nil {
-		return 0, err
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
 	}
 
-	decrypted, err := crypto.Decrypt(ec.key, encrypted)
+	nonce := seqNonce(ec.recvSeq)
+	if len(encrypted) < len(nonce) || subtle.ConstantTimeCompare(encrypted[:len(nonce)], nonce[:]) != 1 {
+		return nil, fmt.Errorf("record out of sequence")
+	}
+	decrypted, err := crypto.Decrypt(ec.recvKey, encrypted)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	copyLen := copy(p, decrypted)
-	if copyLen < len(decrypted) {
-		ec.buf = decrypted[copyLen:]
+	ec.recvSeq++
+	if len(decrypted) == 0 {
+		ec.eofRecv = true
+		return nil, io.EOF
 	}
-	return copyLen, nil
+	return decrypted, nil
+}
+
+// SetDeadline sets the read and write deadline of the underlying connection.
+func (ec *EncryptedConn) SetDeadline(t time.Time) error {
+	return ec.conn.SetDeadline(t)
 }
 
 func (ec *EncryptedConn) Close() error {
@@ -0,0 +1,234 @@
+package transit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// transcript holds the handshakes, relay request and records of a transit
+// connection for a fixed key, as magic-wormhole's transit protocol defines
+// them, followed by the records GoPipe peers add. It is generated, not
+// recorded, by ../../wormhole/testdata/transcripts.py.
+type transcript struct {
+	Key               string   `json:"key"`
+	Side              string   `json:"side"`
+	SenderHandshake   string   `json:"sender_handshake"`
+	ReceiverHandshake string   `json:"receiver_handshake"`
+	RelayRequest      string   `json:"relay_request"`
+	SenderRecords     []record `json:"sender_records"`
+	ReceiverRecords   []record `json:"receiver_records"`
+
+	// The digest and end of stream records that follow between GoPipe
+	// peers; a magic-wormhole peer sends neither.
+	GoPipeSenderRecords   []record `json:"gopipe_sender_records"`
+	GoPipeReceiverRecords []record `json:"gopipe_receiver_records"`
+}
+
+type record struct {
+	Plaintext string `json:"plaintext"`
+	Frame     string `json:"frame"`
+}
+
+func loadTranscript(t *testing.T) transcript {
+	t.Helper()
+	data, err := os.ReadFile("testdata/transit.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tr transcript
+	if err := json.Unmarshal(data, &tr); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newTestTransit returns a Transit with the transcript's key whose winning
+// connection is one end of a pipe; the other end is returned too.
+func newTestTransit(t *testing.T, tr transcript, isSender bool) (*Transit, net.Conn) {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() { ours.Close(); theirs.Close() })
+	tt := NewTransit(mustHex(t, tr.Key), isSender, "")
+	tt.side = tr.Side
+	tt.conn = ours
+	return tt, theirs
+}
+
+func TestHandshake(t *testing.T) {
+	tr := loadTranscript(t)
+	for _, isSender := range []bool{true, false} {
+		tt, peer := newTestTransit(t, tr, isSender)
+		ours, theirs := tr.ReceiverHandshake, tr.SenderHandshake
+		if isSender {
+			ours, theirs = theirs, ours
+		}
+
+		errc := make(chan error, 1)
+		go func() { errc <- tt.handshake(context.Background(), tt.conn) }()
+
+		got := make([]byte, len(ours))
+		if _, err := io.ReadFull(peer, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != ours {
+			t.Errorf("sender %v: sent %q, want %q", isSender, got, ours)
+		}
+		io.WriteString(peer, theirs)
+		if !isSender {
+			io.WriteString(peer, "go\n")
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("sender %v: %v", isSender, err)
+		}
+	}
+}
+
+func TestHandshakeWrongKey(t *testing.T) {
+	tr := loadTranscript(t)
+	tt, peer := newTestTransit(t, tr, true)
+	errc := make(chan error, 1)
+	go func() { errc <- tt.handshake(context.Background(), tt.conn) }()
+
+	io.ReadFull(peer, make([]byte, len(tr.SenderHandshake)))
+	wrong := []byte(tr.ReceiverHandshake)
+	wrong[len("transit receiver ")] ^= 1
+	peer.Write(wrong)
+	if err := <-errc; err == nil {
+		t.Fatal("handshake with the wrong key succeeded")
+	}
+}
+
+func TestRelayRequest(t *testing.T) {
+	tr := loadTranscript(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if line == tr.RelayRequest {
+			io.WriteString(conn, "ok\n")
+		} else {
+			io.WriteString(conn, "bad request\n")
+		}
+	}()
+
+	tt := NewTransit(mustHex(t, tr.Key), true, "")
+	tt.side = tr.Side
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := tt.connectRelay(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatalf("relay did not accept the request: %v", err)
+	}
+	conn.Close()
+}
+
+func TestRecordFraming(t *testing.T) {
+	tr := loadTranscript(t)
+	cases := []struct {
+		peer             string
+		sender, receiver []record
+	}{
+		{"magic-wormhole", tr.SenderRecords, tr.ReceiverRecords},
+		{"gopipe", append(tr.SenderRecords, tr.GoPipeSenderRecords...), append(tr.ReceiverRecords, tr.GoPipeReceiverRecords...)},
+	}
+	for _, tc := range cases {
+		for _, isSender := range []bool{true, false} {
+			testRecords(t, tr, tc.peer, isSender, tc.sender, tc.receiver)
+		}
+	}
+}
+
+// testRecords checks that what one side writes is byte for byte what the
+// transcript has, an empty record being the end of the stream, and that the
+// other side's records read back as their plaintext.
+func testRecords(t *testing.T, tr transcript, peer string, isSender bool, senderRecords, receiverRecords []record) {
+	t.Helper()
+	sent, received := receiverRecords, senderRecords
+	if isSender {
+		sent, received = received, sent
+	}
+	tt, pipe := newTestTransit(t, tr, isSender)
+	conn, err := tt.SecureConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var plaintexts [][]byte
+	for _, r := range sent {
+		plaintexts = append(plaintexts, mustHex(t, r.Plaintext))
+	}
+	go func() {
+		for _, p := range plaintexts {
+			if len(p) > 0 {
+				conn.WriteRecord(p)
+			} else {
+				conn.CloseWrite()
+			}
+		}
+	}()
+	for i, r := range sent {
+		want := mustHex(t, r.Frame)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(pipe, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s, sender %v: record %d is %x, want %x", peer, isSender, i, got, want)
+		}
+	}
+
+	var frames []byte
+	for _, r := range received {
+		frames = append(frames, mustHex(t, r.Frame)...)
+	}
+	go pipe.Write(frames)
+	for i, r := range received {
+		p, err := conn.ReadRecord()
+		if want := mustHex(t, r.Plaintext); len(want) == 0 {
+			if err != io.EOF {
+				t.Errorf("%s, sender %v: record %d: got %v, want end of stream", peer, isSender, i, err)
+			}
+		} else if err != nil || !bytes.Equal(p, want) {
+			t.Errorf("%s, sender %v: record %d is %q (%v), want %q", peer, isSender, i, p, err, want)
+		}
+	}
+}
+
+func TestRecordOutOfSequence(t *testing.T) {
+	tr := loadTranscript(t)
+	tt, peer := newTestTransit(t, tr, false)
+	conn, err := tt.SecureConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := mustHex(t, tr.SenderRecords[1].Frame)
+	go peer.Write(frame)
+	if _, err := conn.ReadRecord(); err == nil {
+		t.Fatal("accepted the second record first")
+	}
+}
@@ -1,13 +1,185 @@
+// Package words generates wormhole codes, such as "7-guitarist-revenge", and
+// helps people type them.
 package words
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"math/rand"
-	"time"
+	"strings"
+	"unicode"
 )
 
-func GenerateCode(id int) string {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	pin := r.Intn(900000) + 100000
-	return fmt.Sprintf("%d-%d", id, pin)
+// DefaultLength is the number of words in a generated code.
+const DefaultLength = 2
+
+// GenerateCode returns the nameplate followed by length words picked with
+// crypto/rand. Each word adds 8 bits to the password.
+func GenerateCode(nameplate string, length int) string {
+	if length < 1 {
+		length = DefaultLength
+	}
+	b := make([]byte, length)
+	rand.Read(b) // never fails
+	parts := []string{nameplate}
+	for i, v := range b {
+		parts = append(parts, word(v, i))
+	}
+	return strings.Join(parts, "-")
+}
+
+// word returns the word for byte v at position i of a code.
+func word(v byte, i int) string {
+	return pgpWords[v][(i+1)%2]
+}
+
+// verifierLength is the number of words a verifier is shown as. A man in
+// the middle has one try to match them, so 32 bits are plenty.
+const verifierLength = 4
+
+// Verifier shows the start of a verifier as words, to be read out and
+// compared. Only GoPipe shows verifiers this way, so they cannot be compared
+// with the hex a magic-wormhole client shows.
+func Verifier(v []byte) string {
+	parts := make([]string, min(len(v), verifierLength))
+	for i := range parts {
+		parts[i] = word(v[i], i)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Normalize turns a code as typed into the code to connect with. It ignores
+// case and surrounding space, accepts spaces, dots and underscores between
+// the words, and corrects words that are a typo or two away from exactly
+// one word of the list.
+func Normalize(code string) (string, error) {
+	fields := strings.FieldsFunc(strings.ToLower(code), isSeparator)
+	if len(fields) < 2 {
+		return "", errors.New("invalid code: expected a number followed by words, e.g. 7-guitarist-revenge")
+	}
+	for _, r := range fields[0] {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("invalid code: %q is not a number", fields[0])
+		}
+	}
+	for i, w := range fields[1:] {
+		fields[i+1] = correct(w, i)
+	}
+	return strings.Join(fields, "-"), nil
+}
+
+func isSeparator(r rune) bool {
+	switch r {
+	case '-', '_', '.', ',', '–', '—':
+		return true
+	}
+	return unicode.IsSpace(r)
+}
+
+// correct returns the word of the list closest to w, the word at position
+// i, if there is exactly one close enough. Otherwise w might come from a
+// client with other codes, such as older GoPipe versions with digits, and
+// is returned unchanged.
+func correct(w string, i int) string {
+	if known[w] {
+		return w
+	}
+	for _, r := range w {
+		if r < 'a' || r > 'z' {
+			return w
+		}
+	}
+	maxDist := 1
+	if len(w) >= 6 {
+		maxDist = 2
+	}
+	// Words of the other parity are tried too, in case the
+	// typo is in the position rather than the word.
+	for _, parity := range []int{(i + 1) % 2, i % 2} {
+		best, bestDist, unique := "", maxDist+1, false
+		for _, pair := range pgpWords {
+			d := distance(w, pair[parity])
+			if d < bestDist {
+				best, bestDist, unique = pair[parity], d, true
+			} else if d == bestDist {
+				unique = false
+			}
+		}
+		if unique {
+			return best
+		}
+		if bestDist <= maxDist {
+			return w // ambiguous
+		}
+	}
+	return w
+}
+
+// known holds every word of the list.
+var known = func() map[string]bool {
+	m := make(map[string]bool, 2*len(pgpWords))
+	for _, pair := range pgpWords {
+		m[pair[0]], m[pair[1]] = true, true
+	}
+	return m
+}()
+
+// distance is the number of single letter insertions, deletions,
+// substitutions and swaps of neighbours that turn a into b.
+func distance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// Complete returns the codes that input, a partly typed code, may be
+// completed to. Up to the first "-" these are the nameplates in use, as
+// listed by the mailbox server; after it, the words of the list that fit
+// the position and start with what was typed. Words before the last of a
+// code of length words are followed by "-", so typing can go on.
+func Complete(input string, nameplates []string, length int) []string {
+	if length < 1 {
+		length = DefaultLength
+	}
+	var completions []string
+	i := strings.LastIndexByte(input, '-')
+	if i < 0 {
+		for _, n := range nameplates {
+			if strings.HasPrefix(n, input) {
+				completions = append(completions, n+"-")
+			}
+		}
+		return completions
+	}
+
+	head, prefix := input[:i+1], strings.ToLower(input[i+1:])
+	pos := strings.Count(head, "-") - 1
+	suffix := "-"
+	if pos >= length-1 {
+		suffix = ""
+	}
+	for v := range pgpWords {
+		if w := word(byte(v), pos); strings.HasPrefix(w, prefix) {
+			completions = append(completions, head+w+suffix)
+		}
+	}
+	return completions
 }
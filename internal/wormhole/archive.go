@@ -0,0 +1,561 @@
+package wormhole
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+// Directories sent between GoPipe peers travel as a tar stream, which keeps
+// permissions, modification times and symlinks, and is unpacked by the
+// receiver as it arrives.
+
+// tarEntry is a file, directory or symlink of the directory being sent.
+type tarEntry struct {
+	path   string // on disk
+	header *tar.Header
+
+	// Filled in by layoutTar.
+	start       int64 // offset of the entry's header in the archive
+	dataStart   int64 // offset of the entry's contents in the archive
+	rawBefore   int64 // bytes of all files before this entry
+	filesBefore int   // number of files before this entry
+}
+
+// tarStream writes the tar archive of a directory. The entries are collected
+// up front, so the size of the archive is known before it is written.
+type tarStream struct {
+	entries []tarEntry
+	meta    transit.Metadata
+	pr      *io.PipeReader
+}
+
+// treeRoot is a file or directory to be archived under name. An empty name
+// puts the contents of a directory at the top of the archive.
+type treeRoot struct {
+	path string
+	name string
+}
+
+// walkRoots calls fn for everything below the roots, and for the roots that
+// have a name, with the name each gets in the archive.
+func walkRoots(roots []treeRoot, fn func(path, name string, info os.FileInfo) error) error {
+	for _, root := range roots {
+		err := filepath.Walk(root.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(root.path, path)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(filepath.Join(root.name, relPath))
+			if name == "." {
+				return nil
+			}
+			return fn(path, name, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prepareTarStream(root string) (io.ReadCloser, transit.Metadata, error) {
+	meta := transit.Metadata{Name: filepath.Base(root), Mode: "dir", Archive: tarMode}
+	return prepareTar(meta, []treeRoot{{path: root}})
+}
+
+// prepareMultiTar archives several files and directories, each under its
+// name, and lists them in meta.Entries.
+func prepareMultiTar(roots []treeRoot) (io.ReadCloser, transit.Metadata, error) {
+	meta := transit.Metadata{Name: fmt.Sprintf("%d items", len(roots)), Mode: "multi", Archive: tarMode}
+	for _, root := range roots {
+		meta.Entries = append(meta.Entries, transit.Entry{Name: root.name, Mode: "file"})
+	}
+	return prepareTar(meta, roots)
+}
+
+func prepareTar(meta transit.Metadata, roots []treeRoot) (io.ReadCloser, transit.Metadata, error) {
+	var entries []tarEntry
+	err := walkRoots(roots, func(path, name string, info os.FileInfo) error {
+		var link string
+		switch mode := info.Mode(); {
+		case mode.IsRegular(), mode.IsDir():
+		case mode&os.ModeSymlink != 0:
+			var err error
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		default:
+			return nil // devices, sockets and pipes are not sent
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		// Owners mean nothing on the receiving machine.
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+
+		if info.Mode().IsRegular() {
+			meta.Files++
+			meta.RawSize += info.Size()
+		}
+		meta.Entries = countEntry(meta.Entries, name, info)
+		entries = append(entries, tarEntry{path: path, header: header})
+		return nil
+	})
+	if err != nil {
+		return nil, meta, err
+	}
+
+	if meta.Size, err = layoutTar(entries); err != nil {
+		return nil, meta, err
+	}
+	return &tarStream{entries: entries, meta: meta}, meta, nil
+}
+
+// countEntry adds the file or directory at name to the manifest entry it
+// belongs to, if any.
+func countEntry(entries []transit.Entry, name string, info os.FileInfo) []transit.Entry {
+	top, _, below := strings.Cut(name, "/")
+	for i := range entries {
+		e := &entries[i]
+		if e.Name != top {
+			continue
+		}
+		if !below && info.IsDir() {
+			e.Mode = "dir"
+		}
+		if info.Mode().IsRegular() {
+			e.Size += info.Size()
+			e.Files++
+		}
+	}
+	return entries
+}
+
+// layoutTar works out where each entry will be in the archive and returns
+// its exact length. Headers do not depend on what precedes them, so each is
+// measured on its own.
+func layoutTar(entries []tarEntry) (int64, error) {
+	var size, raw int64
+	var files int
+	for i := range entries {
+		e := &entries[i]
+		var cw countingWriter
+		if err := tar.NewWriter(&cw).WriteHeader(e.header); err != nil {
+			return 0, err
+		}
+		e.start, e.dataStart = size, size+cw.n
+		e.rawBefore, e.filesBefore = raw, files
+		size = e.dataStart + (e.header.Size+511)/512*512
+		if e.header.Typeflag == tar.TypeReg {
+			raw += e.header.Size
+			files++
+		}
+	}
+	return size + 1024, nil // two zero blocks end the archive
+}
+
+// progress describes a transfer that has sent the first n bytes of the
+// archive, in terms of the files in it.
+func (s *tarStream) progress(n int64) Progress {
+	p := Progress{Total: s.meta.RawSize, FilesTotal: s.meta.Files}
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].dataStart > n }) - 1
+	if i >= 0 {
+		e := s.entries[i]
+		done := min(n-e.dataStart, e.header.Size)
+		p.Current = e.rawBefore + done
+		p.FilesDone = e.filesBefore
+		if e.header.Typeflag == tar.TypeReg {
+			p.FileCurrent, p.FileTotal = done, e.header.Size
+			if done == e.header.Size {
+				p.FilesDone++
+			}
+		}
+		p.File = strings.TrimSuffix(e.header.Name, "/")
+	}
+	p.Ratio = ratio(p.Current, p.Total)
+	return p
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func (s *tarStream) Read(p []byte) (int, error) {
+	if s.pr == nil {
+		s.write(s.entries)
+	}
+	return s.pr.Read(p)
+}
+
+// write starts writing the archive from the given entries on.
+func (s *tarStream) write(entries []tarEntry) {
+	pr, pw := io.Pipe()
+	s.pr = pr
+	go func() { pw.CloseWithError(writeTar(pw, entries)) }()
+}
+
+// Seek writes the archive again from the entry that holds offset, which is
+// where a reconnection takes the stream up, and skips the part of that entry
+// before offset. Headers do not depend on what precedes them, so the entries
+// that follow come out exactly as they did the first time.
+func (s *tarStream) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset < 0 {
+		return 0, errors.New("tar stream can only be positioned from the start")
+	}
+	s.Close()
+	i := max(sort.Search(len(s.entries), func(i int) bool { return s.entries[i].start > offset })-1, 0)
+	var start int64
+	if i < len(s.entries) {
+		start = s.entries[i].start
+	}
+	s.write(s.entries[i:])
+	if _, err := io.CopyN(io.Discard, s.pr, offset-start); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (s *tarStream) Close() error {
+	if s.pr == nil {
+		return nil
+	}
+	return s.pr.Close()
+}
+
+func writeTar(w io.Writer, entries []tarEntry) error {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.header); err != nil {
+			return err
+		}
+		if e.header.Typeflag != tar.TypeReg {
+			continue
+		}
+		f, err := os.Open(e.path)
+		if err != nil {
+			return &sourceError{name: e.header.Name, err: err}
+		}
+		_, err = io.CopyN(tw, f, e.header.Size)
+		f.Close()
+		if err == io.EOF {
+			err = errors.New("file shrank while sending")
+		}
+		if err != nil {
+			// Errors writing to tw come from the pipe, which is only
+			// closed when the stream is abandoned.
+			return &sourceError{name: e.header.Name, err: err}
+		}
+	}
+	return tw.Close()
+}
+
+// treeDownload unpacks a tar stream into a temporary directory while it
+// arrives. Written data goes to the extractor through a pipe.
+type treeDownload struct {
+	dir      string
+	meta     transit.Metadata
+	pw       *io.PipeWriter
+	done     chan error
+	closed   bool
+	err      error
+	unpacked extractProgress
+}
+
+// extractProgress is kept up to date by extractTar.
+type extractProgress struct {
+	mu      sync.Mutex
+	name    string // entry being unpacked
+	size    int64  // size of that entry
+	written int64  // bytes of that entry written
+	bytes   int64  // file contents written
+	files   int    // files completed
+}
+
+// begin starts on the next entry.
+func (p *extractProgress) begin(name string, size int64) {
+	p.mu.Lock()
+	p.name, p.size, p.written = name, size, 0
+	p.mu.Unlock()
+}
+
+func (p *extractProgress) update(n int64, fileDone bool) {
+	p.mu.Lock()
+	p.written += n
+	p.bytes += n
+	if fileDone {
+		p.files++
+	}
+	p.mu.Unlock()
+}
+
+func startTreeDownload(outDir, name string, meta transit.Metadata) (*treeDownload, error) {
+	dir, err := os.MkdirTemp(outDir, name+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	x := &treeDownload{dir: dir, meta: meta, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := extractTar(pr, dir, &x.unpacked)
+		pr.CloseWithError(err)
+		x.done <- err
+	}()
+	return x, nil
+}
+
+// progress reports what has been unpacked so far.
+func (x *treeDownload) progress() Progress {
+	x.unpacked.mu.Lock()
+	defer x.unpacked.mu.Unlock()
+	return Progress{
+		Current:     x.unpacked.bytes,
+		Total:       x.meta.RawSize,
+		Ratio:       ratio(x.unpacked.bytes, x.meta.RawSize),
+		File:        x.unpacked.name,
+		FileCurrent: x.unpacked.written,
+		FileTotal:   x.unpacked.size,
+		FilesDone:   x.unpacked.files,
+		FilesTotal:  x.meta.Files,
+	}
+}
+
+func (x *treeDownload) Write(p []byte) (int, error) {
+	return x.pw.Write(p)
+}
+
+// close ends the stream and waits for everything to be unpacked.
+func (x *treeDownload) close() error {
+	if !x.closed {
+		x.closed = true
+		x.pw.Close()
+		x.err = <-x.done
+	}
+	return x.err
+}
+
+// finish moves the unpacked tree to outPath.
+func (x *treeDownload) finish(outPath string) error {
+	if err := x.close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(x.dir, 0o755); err != nil {
+		return err
+	}
+	return os.Rename(x.dir, outPath)
+}
+
+// finishEntries moves each of the unpacked entries into outDir, next to any
+// file of the same name, and returns the names they were given.
+func (x *treeDownload) finishEntries(outDir string, entries []transit.Entry) ([]string, error) {
+	if err := x.close(); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		outPath := uniquePath(outDir, e.Name)
+		if err := os.Rename(filepath.Join(x.dir, e.Name), outPath); err != nil {
+			return names, err
+		}
+		names = append(names, filepath.Base(outPath))
+	}
+	os.RemoveAll(x.dir)
+	return names, nil
+}
+
+// abort stops the extraction and removes what was unpacked.
+func (x *treeDownload) abort() {
+	if !x.closed {
+		x.closed = true
+		x.pw.CloseWithError(errors.New("transfer aborted"))
+		x.err = <-x.done
+	}
+	os.RemoveAll(x.dir)
+}
+
+// extractTar unpacks the archive read from r into dir. Every entry must stay
+// inside dir: absolute names and ".." components are rejected, entries may
+// not be placed below a symlink, and symlinks may only point within the
+// tree, checked against what is already on disk by linkInside. Everything
+// is done through an os.Root as a second line of defence.
+func extractTar(r io.Reader, dir string, unpacked *extractProgress) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	type dirTimes struct {
+		name  string
+		mode  os.FileMode
+		mtime time.Time
+	}
+	var dirs []dirTimes
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(strings.TrimSuffix(header.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("unsafe path in archive: %q", header.Name)
+		}
+		if err := makeParents(root, name); err != nil {
+			return err
+		}
+		mode := header.FileInfo().Mode().Perm()
+		unpacked.begin(name, header.Size)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := root.Mkdir(name, 0o755); err != nil {
+				if info, sErr := root.Lstat(name); sErr != nil || !info.IsDir() {
+					return err
+				}
+			}
+			dirs = append(dirs, dirTimes{name, mode, header.ModTime})
+
+		case tar.TypeReg:
+			f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(&progressWriter{f, unpacked}, tr)
+			if err == nil {
+				err = f.Chmod(mode)
+			}
+			if cErr := f.Close(); err == nil {
+				err = cErr
+			}
+			if err != nil {
+				return err
+			}
+			root.Chtimes(name, time.Time{}, header.ModTime)
+			unpacked.update(0, true)
+
+		case tar.TypeSymlink:
+			target := filepath.FromSlash(header.Linkname)
+			if !linkInside(root, name, target) {
+				return fmt.Errorf("unsafe symlink in archive: %q -> %q", header.Name, header.Linkname)
+			}
+			if err := root.Symlink(target, name); err != nil {
+				return err
+			}
+
+		default:
+			// Hard links, devices and the like are not sent by GoPipe.
+		}
+	}
+
+	// Children change their directory's mtime, and a read-only directory
+	// could not have been filled, so directories are finished last.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		root.Chtimes(dirs[i].name, time.Time{}, dirs[i].mtime)
+		root.Chmod(dirs[i].name, dirs[i].mode)
+	}
+
+	// Consume the end of the archive, so the writer is never left blocked.
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// progressWriter counts the bytes written to a file being unpacked.
+type progressWriter struct {
+	w        io.Writer
+	unpacked *extractProgress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.unpacked.update(int64(n), false)
+	return n, err
+}
+
+// linkInside reports whether a symlink at name pointing to target stays
+// inside root. Following a link that is already there and going down again
+// cannot leave the tree, as that link was checked too; only ".." can. So
+// every ".." must step out of a real directory that exists now, which cannot
+// be turned into a symlink by a later entry, and never out of root itself.
+func linkInside(root *os.Root, name, target string) bool {
+	if target == "" || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return false
+	}
+	var path []string
+	if dir := filepath.Dir(name); dir != "." {
+		path = strings.Split(dir, string(filepath.Separator))
+	}
+	for _, part := range strings.Split(target, string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(path) == 0 {
+				return false
+			}
+			info, err := root.Lstat(filepath.Join(path...))
+			if err != nil || !info.IsDir() {
+				return false
+			}
+			path = path[:len(path)-1]
+		default:
+			path = append(path, part)
+		}
+	}
+	return true
+}
+
+// makeParents creates the directories leading up to name inside root. An
+// existing component that is not a real directory, such as a symlink that
+// arrived earlier, is an error.
+func makeParents(root *os.Root, name string) error {
+	parent := filepath.Dir(name)
+	if parent == "." {
+		return nil
+	}
+	var path string
+	for _, part := range strings.Split(parent, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		info, err := root.Lstat(path)
+		if os.IsNotExist(err) {
+			if err := root.Mkdir(path, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("unsafe path in archive: %q is not a directory", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package wormhole
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarOf builds an archive of symlinks, given as name and target pairs, and
+// ends it with a file written to last.
+func tarOf(t *testing.T, links [][2]string, last string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, l := range links {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: l[0], Linkname: l[1], Mode: 0o777}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last != "" {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: last, Size: 5, Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("owned"))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTarTraversal(t *testing.T) {
+	tests := []struct {
+		name  string
+		links [][2]string
+		file  string
+	}{
+		{"dotdot name", nil, "../escape"},
+		{"dotdot inside name", nil, "a/../../escape"},
+		{"absolute link", [][2]string{{"l", "/tmp"}}, ""},
+		{"dotdot link", [][2]string{{"l", ".."}}, ""},
+		{"nested dotdot link", [][2]string{{"a/l", "../.."}}, ""},
+		{"link chain", [][2]string{{"a/l", ".."}, {"x", "a/l/.."}}, ""},
+		{"longer chain", [][2]string{{"a/b/l", "../.."}, {"a/m", "b/l/.."}, {"x", "a/m/.."}}, ""},
+		{"link to a later link", [][2]string{{"x", "b/.."}, {"b", "a/l"}}, ""},
+		{"file below a link", [][2]string{{"l", "."}}, "l/escape"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "tree")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			err := extractTar(bytes.NewReader(tarOf(t, tt.links, tt.file)), dir, &extractProgress{})
+			if err == nil {
+				t.Error("unsafe archive was unpacked")
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escape")); err == nil {
+				t.Error("a file was written outside the tree")
+			}
+		})
+	}
+}
+
+func TestExtractTarLinks(t *testing.T) {
+	// Links may climb out of real directories and through each other, as
+	// long as they stay inside the tree.
+	dir := t.TempDir()
+	links := [][2]string{{"a/b/up", "../.."}, {"a/down", "b/up/a"}, {"later", "z/file"}}
+	if err := extractTar(bytes.NewReader(tarOf(t, links, "a/b/file")), dir, &extractProgress{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "a", "down", "b", "file")); err != nil || string(data) != "owned" {
+		t.Errorf("links inside the tree do not resolve: %q, %v", data, err)
+	}
+}
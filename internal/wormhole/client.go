@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/frostbyte57/GoPipe/internal/crypto"
 	"github.com/frostbyte57/GoPipe/internal/mailbox"
@@ -20,20 +23,88 @@ const (
 	AppID = "lothar.com/wormhole/text-or-file-xfer"
 )
 
+// ErrWrongCode is returned by PerformHandshake when the peer derived a
+// different key: the code was mistyped, or someone guessed it wrong.
+var ErrWrongCode = errors.New("key confirmation failed: the code is wrong, or an attacker guessed it")
+
+// sourceError is a failure to read what is being sent. It names the entry
+// relative to what was offered, so it can be reported to the peer.
+type sourceError struct {
+	name string
+	err  error
+}
+
+func (e *sourceError) Error() string {
+	return fmt.Sprintf("cannot read %s: %s", e.name, abortReason(e.err))
+}
+
+func (e *sourceError) Unwrap() error { return e.err }
+
+// abortReason describes err for the peer without revealing local paths.
+func abortReason(err error) string {
+	var srcErr *sourceError
+	if errors.As(err, &srcErr) {
+		return srcErr.Error()
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// ErrHashMismatch is returned by SendFile and ReceiveFile when the data the
+// receiver wrote does not hash to what the sender read.
+var ErrHashMismatch = errors.New("transfer corrupted: SHA-256 of the received data does not match")
+
+// ErrDeclined is returned by SendFile when the receiver turned the offer
+// down.
+var ErrDeclined = errors.New("receiver declined the transfer")
+
+// ErrNoSpace is returned by ReceiveFile when the output directory does not
+// have room for the offer. The offer is declined.
+var ErrNoSpace = errors.New("not enough free disk space")
+
+// ErrVerifierMismatch is returned when the user saw a different verifier
+// than the peer, so someone in the middle may be reading along.
+var ErrVerifierMismatch = errors.New("verifiers do not match, the connection may be intercepted")
+
 type Client struct {
 	mail  *mailbox.Client
 	side  string
 	appID string
+	relay string
 
-	code      string
-	mailboxID string
+	code string
+
+	// The state of the mailbox protocol, kept by run; see state.go.
+	mu         sync.Mutex
+	state      mailboxState
+	nameplate  string
+	mailboxID  string
+	inbox      map[string]mailbox.MessageMessage // the peer's messages not taken yet, by phase
+	nameplates []string                          // answer to a list request
+	mailErr    error                             // why the mailbox cannot be used anymore
+	changed    chan struct{}                     // closed and replaced on every event
 
 	spake2   *gospake2.SPAKE2
 	key      []byte // Session key
 	isSender bool
+
+	nextPhase     int // our next numbered phase
+	nextPeerPhase int // the peer's next numbered phase
+
+	peerAbilities map[string]bool // GoPipe extensions the peer supports
+	attempt       int             // transit connections replaced so far
+
+	zipDirectories bool          // receive directories as a zip file
+	codeLength     int           // words in the codes we generate
+	offer          *pendingOffer // received by ReceiveOffer, not answered yet
 }
 
-func NewClient(side string, mailboxURL string) *Client {
+// NewClient creates a client. relay is the transit relay address offered to
+// the peer as a fallback; pass an empty string to only connect directly.
+func NewClient(side string, mailboxURL string, relay string) *Client {
 	if side == "" {
 		b, _ := crypto.RandomBytes(8)
 		side = hex.EncodeToString(b)
@@ -42,54 +113,80 @@ func NewClient(side string, mailboxURL string) *Client {
 		mail:  mailbox.NewClient(mailboxURL, AppID, side),
 		side:  side,
 		appID: AppID,
+		relay: relay,
+
+		inbox:   make(map[string]mailbox.MessageMessage),
+		changed: make(chan struct{}),
 	}
 }
 
+// SetZipDirectories makes the receiver save directories as a zip archive
+// instead of unpacking them. It must be called before PerformHandshake.
+func (c *Client) SetZipDirectories(zip bool) {
+	c.zipDirectories = zip
+}
+
+// SetCodeLength sets the number of words in the code PrepareSend and
+// PrepareRequest generate. Longer codes are harder to guess, and harder to
+// type.
+func (c *Client) SetCodeLength(n int) {
+	c.codeLength = n
+}
+
 // PrepareSend connects, allocates a nameplate, and generates a code.
 func (c *Client) PrepareSend(ctx context.Context) (code string, err error) {
 	c.isSender = true
+	return c.allocate(ctx)
+}
+
+// PrepareRequest is PrepareSend for the receiver: the side that needs a file
+// generates the code, and the sender joins with PrepareSendCode.
+func (c *Client) PrepareRequest(ctx context.Context) (code string, err error) {
+	c.isSender = false
+	return c.allocate(ctx)
+}
+
+// PrepareReceive connects using a code.
+func (c *Client) PrepareReceive(ctx context.Context, code string) error {
+	c.isSender = false
+	return c.join(ctx, code)
+}
+
+// PrepareSendCode connects using a code generated by the receiver with
+// PrepareRequest.
+func (c *Client) PrepareSendCode(ctx context.Context, code string) error {
+	c.isSender = true
+	return c.join(ctx, code)
+}
+
+// allocate connects, allocates a nameplate, and generates a code.
+func (c *Client) allocate(ctx context.Context) (code string, err error) {
 	if err := c.connect(ctx); err != nil {
 		return "", err
 	}
 
+	if err := c.transition(stateConnected, stateAllocating); err != nil {
+		return "", err
+	}
 	if err := c.mail.Allocate(ctx); err != nil {
 		return "", err
 	}
-
-	// Wait for "allocated"
-	var allocated mailbox.AllocatedMessage
-	for {
-		select {
-		case ev := <-c.mail.EventChan:
-			if msg, ok := ev.(mailbox.AllocatedMessage); ok {
-				allocated = msg
-				goto Allocated
-			} else if _, ok := ev.(mailbox.WelcomeMessage); ok {
-				continue
-			} else {
-				return "", fmt.Errorf("unexpected event waiting for allocated: %T", ev)
-			}
-		case <-ctx.Done():
-			return "", ctx.Err()
-		}
+	err = c.await(ctx, func() bool { return c.state == stateAllocated })
+	if err != nil {
+		return "", err
 	}
-Allocated:
 
-	nameplate := allocated.Nameplate
-	id, _ := strconv.Atoi(nameplate)
-	c.code = words.GenerateCode(id) // e.g. "7-foo-bar"
-	c.mailboxID = nameplate
+	nameplate := c.nameplate
+	c.code = words.GenerateCode(nameplate, c.codeLength) // e.g. "7-guitarist-revenge"
 
-	if err := c.mail.Open(ctx, nameplate); err != nil {
+	if err := c.claim(ctx, nameplate); err != nil {
 		return "", err
 	}
-
 	return c.code, nil
 }
 
-// PrepareReceive connects using a code.
-func (c *Client) PrepareReceive(ctx context.Context, code string) error {
-	c.isSender = false
+// join connects and claims the nameplate of a code generated by the peer.
+func (c *Client) join(ctx context.Context, code string) error {
 	c.code = code
 
 	var nameplate string
@@ -102,150 +199,319 @@ func (c *Client) PrepareReceive(ctx context.Context, code string) error {
 	if nameplate == "" {
 		return fmt.Errorf("invalid code format")
 	}
-	c.mailboxID = nameplate
 
 	if err := c.connect(ctx); err != nil {
 		return err
 	}
+	return c.claim(ctx, nameplate)
+}
 
-	if err := c.mail.Claim(ctx, nameplate); err != nil {
-		return err
+// ListNameplates returns the nameplates in use on the mailbox server, to
+// complete codes as they are typed.
+func ListNameplates(ctx context.Context, mailboxURL string) ([]string, error) {
+	c := NewClient("", mailboxURL, "")
+	if err := c.connect(ctx); err != nil {
+		return nil, err
 	}
-
-	for {
-		select {
-		case ev := <-c.mail.EventChan:
-			if _, ok := ev.(mailbox.ClaimedMessage); ok {
-				goto Claimed
-			} else if _, ok := ev.(mailbox.WelcomeMessage); ok {
-				continue
-			} else {
-				return fmt.Errorf("unexpected event waiting for claimed: %T", ev)
-			}
-		case <-ctx.Done():
-			return ctx.Err()
-		}
+	defer c.mail.Close()
+	if err := c.mail.List(ctx); err != nil {
+		return nil, err
 	}
-Claimed:
-
-	return c.mail.Open(ctx, nameplate)
+	if err := c.await(ctx, func() bool { return c.nameplates != nil }); err != nil {
+		return nil, err
+	}
+	return c.nameplates, nil
 }
 
 func (c *Client) connect(ctx context.Context) error {
-	return c.mail.Connect(ctx)
+	if err := c.transition(stateIdle, stateConnected); err != nil {
+		return err
+	}
+	if err := c.mail.Connect(ctx); err != nil {
+		c.transition(stateConnected, stateIdle)
+		return err
+	}
+	go c.run()
+	return nil
+}
+
+// claim claims the nameplate and opens the mailbox it points to.
+func (c *Client) claim(ctx context.Context, nameplate string) error {
+	c.mu.Lock()
+	ok := c.state == stateConnected || c.state == stateAllocated
+	if ok {
+		c.nameplate = nameplate
+		c.state = stateClaiming
+	}
+	c.mu.Unlock()
+	if !ok {
+		return errOutOfOrder
+	}
+	if err := c.mail.Claim(ctx, nameplate); err != nil {
+		return err
+	}
+	if err := c.await(ctx, func() bool { return c.state == stateOpen }); err != nil {
+		return err
+	}
+	return c.mail.Open(ctx, c.mailboxID)
 }
 
-// PerformHashshake executes SPAKE2.
+// PerformHandshake runs SPAKE2 with the peer, then exchanges encrypted
+// "version" messages to confirm that both sides derived the same key.
 func (c *Client) PerformHandshake(ctx context.Context) (key []byte, err error) {
 	pw := gospake2.NewPassword(c.code)
-	idA := gospake2.NewIdentityA("sender")
-	idB := gospake2.NewIdentityB("receiver")
-
-	var sp gospake2.SPAKE2
-	if c.isSender {
-		sp = gospake2.SPAKE2A(pw, idA, idB)
-	} else {
-		sp = gospake2.SPAKE2B(pw, idA, idB)
-	}
+	sp := gospake2.SPAKE2Symmetric(pw, gospake2.NewIdentityS(c.appID))
 	c.spake2 = &sp
 
 	msgOut := sp.Start()
 
-	bodyHex := hex.EncodeToString(msgOut)
-	if err := c.mail.Add(ctx, "pake", bodyHex); err != nil {
+	body, _ := json.Marshal(pakeMessage{PakeV1: hex.EncodeToString(msgOut)})
+	if err := c.mail.Add(ctx, "pake", hex.EncodeToString(body)); err != nil {
 		return nil, err
 	}
 
-	// Wait for peer "pake"
-	var msgIn mailbox.MessageMessage
-	found := false
-	for !found {
-		select {
-		case ev, ok := <-c.mail.EventChan:
-			if !ok {
-				return nil, fmt.Errorf("channel closed")
-			}
-			if m, ok := ev.(mailbox.MessageMessage); ok {
-				if m.Side == c.side {
-					continue
-				}
-				if m.Phase == "pake" {
-					msgIn = m
-					found = true
-				}
-			}
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
+	msgIn, err := c.waitPhase(ctx, "pake")
+	if err != nil {
+		return nil, err
 	}
 
+	var peerPake pakeMessage
 	peerBody, err := hex.DecodeString(msgIn.Body)
+	if err == nil {
+		err = json.Unmarshal(peerBody, &peerPake)
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid pake message: %w", err)
+	}
+	peerMsg, err := hex.DecodeString(peerPake.PakeV1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pake message: %w", err)
 	}
 
-	key, err = sp.Finish(peerBody)
+	key, err = sp.Finish(peerMsg)
 	if err != nil {
 		return nil, fmt.Errorf("spake2 handshake failed: %w", err)
 	}
-
 	c.key = key
+
+	// Both sides are in the mailbox now, so the nameplate can be reused.
+	if err := c.mail.Release(ctx, c.nameplate); err != nil {
+		return nil, err
+	}
+
+	version := versionMessage{AppVersions: appVersions{GoPipe: &gopipeVersion{Abilities: c.abilities(), Role: c.role()}}}
+	if err := c.addEncrypted(ctx, "version", version); err != nil {
+		return nil, err
+	}
+	var peerVersion versionMessage
+	if err := c.receivePhase(ctx, "version", &peerVersion); err != nil {
+		if errors.Is(err, errDecrypt) {
+			c.closeMailbox("scary")
+			return nil, ErrWrongCode
+		}
+		return nil, err
+	}
+	c.peerAbilities = make(map[string]bool)
+	if v := peerVersion.AppVersions.GoPipe; v != nil {
+		for _, a := range v.Abilities {
+			c.peerAbilities[a] = true
+		}
+		// Either side may generate the code, so nothing stops both from
+		// sending, or both from receiving, with it.
+		if v.Role == c.role() {
+			c.closeMailbox("errory")
+			if c.isSender {
+				return nil, errors.New("the peer is sending too; one side must receive")
+			}
+			return nil, errors.New("the peer is receiving too; one side must send")
+		}
+	}
+
 	return key, nil
 }
 
-func (c *Client) PerformTransfer(ctx context.Context) (io.ReadWriteCloser, error) {
-	t := transit.NewTransit(c.key)
-	localHints, err := t.Start()
-	if err != nil {
-		return nil, fmt.Errorf("transit start failed: %w", err)
+// Verifier returns a hash of the session key for the users to compare, for
+// example over the phone. It differs between the sides if someone in the
+// middle, such as a malicious mailbox server that guessed the code, made a
+// key exchange with each. magic-wormhole derives it the same way, but shows
+// it in hex rather than as words.
+func (c *Client) Verifier() []byte {
+	return crypto.DeriveKey(c.key, nil, "wormhole:verifier")
+}
+
+// RejectVerifier tells the peer that the user saw a different verifier, and
+// closes the mailbox.
+func (c *Client) RejectVerifier(ctx context.Context) error {
+	err := c.sendMessage(ctx, appMessage{Error: "verifiers do not match"})
+	c.closeMailbox("scary")
+	return err
+}
+
+// abilities returns the GoPipe extensions we offer to the peer.
+func (c *Client) abilities() []string {
+	var abilities []string
+	for _, a := range ourAbilities {
+		if a == abilityTar && c.zipDirectories {
+			continue
+		}
+		abilities = append(abilities, a)
+	}
+	return abilities
+}
+
+// role is "sender" or "receiver".
+func (c *Client) role() string {
+	if c.isSender {
+		return "sender"
+	}
+	return "receiver"
+}
+
+// peerCan reports whether the peer supports a GoPipe protocol extension.
+func (c *Client) peerCan(ability string) bool {
+	return c.peerAbilities[ability]
+}
+
+// transitKey derives the key protecting the transit connection. Every
+// reconnection gets its own key, since record nonces start again at zero.
+func (c *Client) transitKey() []byte {
+	purpose := c.appID + "/transit-key"
+	if c.attempt > 0 {
+		purpose += "/" + strconv.Itoa(c.attempt)
 	}
+	return crypto.DeriveKey(c.key, nil, purpose)
+}
+
+var errDecrypt = errors.New("cannot decrypt message from peer")
 
-	msgStruct := transit.TransitMessage{Hints: localHints}
-	msgBytes, _ := json.Marshal(msgStruct)
+// sendMessage sends v in our next numbered phase.
+func (c *Client) sendMessage(ctx context.Context, v appMessage) error {
+	phase := strconv.Itoa(c.nextPhase)
+	c.nextPhase++
+	return c.addEncrypted(ctx, phase, v)
+}
+
+// receiveMessage returns the peer's next numbered phase.
+func (c *Client) receiveMessage(ctx context.Context) (appMessage, error) {
+	phase := strconv.Itoa(c.nextPeerPhase)
+	c.nextPeerPhase++
 
-	encryptedHints, err := crypto.Encrypt(c.key, msgBytes)
+	var msg appMessage
+	err := c.receivePhase(ctx, phase, &msg)
+	return msg, err
+}
+
+// addEncrypted encrypts v with the key of our side and the given phase.
+func (c *Client) addEncrypted(ctx context.Context, phase string, v interface{}) error {
+	plaintext, err := json.Marshal(v)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	encrypted, err := crypto.Encrypt(crypto.DerivePhaseKey(c.key, c.side, phase), plaintext)
+	if err != nil {
+		return err
+	}
+	return c.mail.Add(ctx, phase, hex.EncodeToString(encrypted))
+}
 
-	encryptedHex := hex.EncodeToString(encryptedHints)
-	if err := c.mail.Add(ctx, "transit", encryptedHex); err != nil {
-		return nil, err
+// receivePhase waits for the peer's message in phase and decrypts it into v.
+func (c *Client) receivePhase(ctx context.Context, phase string, v interface{}) error {
+	m, err := c.waitPhase(ctx, phase)
+	if err != nil {
+		return err
+	}
+	encrypted, err := hex.DecodeString(m.Body)
+	if err != nil {
+		return errDecrypt
 	}
+	plaintext, err := crypto.Decrypt(crypto.DerivePhaseKey(c.key, m.Side, phase), encrypted)
+	if err != nil {
+		return errDecrypt
+	}
+	return json.Unmarshal(plaintext, v)
+}
 
-	// Wait for phase "transit"
-	var peerMsgBytes []byte
-	found := false
-	for !found {
-		select {
-		case ev := <-c.mail.EventChan:
-			if m, ok := ev.(mailbox.MessageMessage); ok {
-				if m.Side == c.side {
-					continue
-				}
-				if m.Phase == "transit" {
-					peerMsgBytes, _ = hex.DecodeString(m.Body)
-					found = true
-				}
-			}
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
+// abort tells the peer why we are giving up on the transfer, so it does not
+// mistake the closed connection for a network problem.
+func (c *Client) abort(ctx context.Context, err error) {
+	c.sendMessage(ctx, appMessage{Error: "transfer aborted: " + abortReason(err)})
+}
+
+// peerError is an error message sent by the peer.
+type peerError struct {
+	peer string // "sender" or "receiver"
+	msg  string
+}
+
+func (e *peerError) Error() string { return e.peer + ": " + e.msg }
+
+func (c *Client) peerError(msg string) error {
+	if c.isSender {
+		return &peerError{peer: "receiver", msg: msg}
+	}
+	return &peerError{peer: "sender", msg: msg}
+}
+
+// closeMailbox tells the server we are done with the mailbox. The mood
+// ("happy", "scary", "errory", ...) is recorded by the server for statistics.
+func (c *Client) closeMailbox(mood string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.mu.Lock()
+	open := c.state == stateOpen
+	if open {
+		c.state = stateClosing
+	}
+	c.mu.Unlock()
+	if open {
+		// Our last messages may still be on their way if the connection
+		// dropped; the server answers once it has them.
+		c.mail.CloseMailbox(ctx, c.mailboxID, mood)
 	}
+	c.mail.Close()
+}
 
-	decryptedHints, err := crypto.Decrypt(c.key, peerMsgBytes)
+func moodFor(err error) string {
 	if err != nil {
-		return nil, fmt.Errorf("decrypt hints failed: %w", err)
+		return "errory"
+	}
+	return "happy"
+}
+
+// connectTimeout bounds the search for a transit connection to the peer.
+const connectTimeout = 30 * time.Second
+
+// PerformTransfer connects to the peer using the hints it sent and returns
+// the encrypted transit connection.
+func (c *Client) PerformTransfer(ctx context.Context, t *transit.Transit, peer transit.TransitMessage) (*transit.EncryptedConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	if err := t.ConnectToPeer(ctx, peer.Hints); err != nil {
+		return nil, fmt.Errorf("transit connect failed: %w", err)
 	}
+	return t.SecureConnection()
+}
 
-	var peerTransitMsg transit.TransitMessage
-	if err := json.Unmarshal(decryptedHints, &peerTransitMsg); err != nil {
+// startTransit listens for the peer and sends it our connection hints.
+func (c *Client) startTransit(ctx context.Context) (*transit.Transit, error) {
+	t, hints, err := c.listen()
+	if err != nil {
 		return nil, err
 	}
 
-	if err := t.ConnectToPeer(ctx, peerTransitMsg.Hints); err != nil {
-		return nil, fmt.Errorf("transit connect failed: %w", err)
+	msg := &transit.TransitMessage{Abilities: transit.Abilities, Hints: hints}
+	if err := c.sendMessage(ctx, appMessage{Transit: msg}); err != nil {
+		t.Close()
+		return nil, err
 	}
+	return t, nil
+}
 
-	return t.SecureConnection()
+func (c *Client) listen() (*transit.Transit, []transit.Hint, error) {
+	t := transit.NewTransit(c.transitKey(), c.isSender, c.relay)
+	hints, err := t.Start()
+	if err != nil {
+		return nil, nil, fmt.Errorf("transit start failed: %w", err)
+	}
+	return t, hints, nil
 }
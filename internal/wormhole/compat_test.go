@@ -0,0 +1,218 @@
+package wormhole
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/frostbyte57/GoPipe/internal/crypto"
+	"github.com/frostbyte57/GoPipe/internal/mailbox"
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+// transcript is a session as it would appear on the mailbox server for a
+// fixed session key. It is generated, not recorded, by testdata/transcripts.py,
+// which follows magic-wormhole's derive_key and derive_phase_key and seals
+// the message bodies with its own XSalsa20-Poly1305. The version message of
+// the sending side is GoPipe's; the rest is what magic-wormhole sends too.
+type transcript struct {
+	AppID      string              `json:"appid"`
+	Key        string              `json:"key"`
+	Verifier   string              `json:"verifier"`
+	TransitKey string              `json:"transit_key"`
+	Messages   []transcriptMessage `json:"messages"`
+}
+
+type transcriptMessage struct {
+	Side      string `json:"side"`
+	Phase     string `json:"phase"`
+	Body      string `json:"body"`
+	PakeV1    string `json:"pake_v1,omitempty"`
+	Plaintext string `json:"plaintext,omitempty"`
+}
+
+func loadTranscript(t *testing.T) transcript {
+	t.Helper()
+	data, err := os.ReadFile("testdata/transcript.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tr transcript
+	if err := json.Unmarshal(data, &tr); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// transcriptClient returns a client that completed the key exchange of the
+// transcript.
+func transcriptClient(t *testing.T, tr transcript) *Client {
+	t.Helper()
+	key, err := hex.DecodeString(tr.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient("", "", "")
+	c.key = key
+	c.state = stateOpen
+	return c
+}
+
+func TestTranscriptKeys(t *testing.T) {
+	tr := loadTranscript(t)
+	if tr.AppID != AppID {
+		t.Fatalf("transcript is for %q, not %q", tr.AppID, AppID)
+	}
+	c := transcriptClient(t, tr)
+	if got := hex.EncodeToString(c.Verifier()); got != tr.Verifier {
+		t.Errorf("verifier %s, want %s", got, tr.Verifier)
+	}
+	if got := hex.EncodeToString(c.transitKey()); got != tr.TransitKey {
+		t.Errorf("transit key %s, want %s", got, tr.TransitKey)
+	}
+}
+
+// TestTranscriptPake checks how pake messages are framed. Their pake_v1
+// values are placeholders rather than SPAKE2 output, so the exchange itself
+// is only covered by the end-to-end tests, with the SPAKE2 library.
+func TestTranscriptPake(t *testing.T) {
+	tr := loadTranscript(t)
+	for _, m := range tr.Messages {
+		if m.Phase != "pake" {
+			continue
+		}
+		body, err := hex.DecodeString(m.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pake pakeMessage
+		if err := json.Unmarshal(body, &pake); err != nil || pake.PakeV1 != m.PakeV1 {
+			t.Errorf("pake message from %s: got %q (%v), want %q", m.Side, pake.PakeV1, err, m.PakeV1)
+		}
+	}
+}
+
+func TestTranscriptEncryption(t *testing.T) {
+	tr := loadTranscript(t)
+	c := transcriptClient(t, tr)
+	for _, m := range tr.Messages {
+		if m.Phase == "pake" {
+			continue
+		}
+		body, err := hex.DecodeString(m.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nonce [24]byte
+		copy(nonce[:], body)
+		got, err := crypto.EncryptWithNonce(crypto.DerivePhaseKey(c.key, m.Side, m.Phase), nonce, []byte(m.Plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(got) != m.Body {
+			t.Errorf("%s/%s: encrypted to %x, want %s", m.Side, m.Phase, got, m.Body)
+		}
+	}
+}
+
+// transcriptBodies are the messages of the transcript as GoPipe decodes
+// them, by side and phase. Those marked exact are sent by GoPipe in just
+// this form; the others come from a magic-wormhole client and only have to
+// be understood.
+var transcriptBodies = map[string]struct {
+	exact bool
+	v     interface{}
+}{
+	"1f3e6a09c2/version": {true, &versionMessage{AppVersions: appVersions{GoPipe: &gopipeVersion{
+		Abilities: []string{abilityEOS, abilityDigest},
+		Role:      "sender",
+	}}}},
+	"b70d41e8aa/version": {true, &versionMessage{}},
+	"1f3e6a09c2/0": {true, &appMessage{Transit: &transit.TransitMessage{
+		Abilities: transit.Abilities,
+		Hints: []transit.Hint{
+			{Type: transit.HintDirectTCP, Priority: 1, Hostname: "192.0.2.2", Port: 40321},
+			{Type: transit.HintRelay, Hints: []transit.Hint{{Type: transit.HintDirectTCP, Hostname: "transit.magic-wormhole.io", Port: 4001}}},
+		},
+	}}},
+	"1f3e6a09c2/1": {true, &appMessage{Offer: &offer{File: &fileOffer{Filename: "hello.txt", Filesize: 12}}}},
+	"b70d41e8aa/0": {false, &appMessage{Transit: &transit.TransitMessage{
+		Abilities: transit.Abilities,
+		Hints: []transit.Hint{
+			{Type: transit.HintDirectTCP, Hostname: "198.51.100.7", Port: 4002},
+			{Type: transit.HintRelay, Hints: []transit.Hint{{Type: transit.HintDirectTCP, Hostname: "transit.magic-wormhole.io", Port: 4001}}},
+		},
+	}}},
+	"b70d41e8aa/1": {true, &appMessage{Answer: &answer{FileAck: "ok"}}},
+	"1f3e6a09c2/2": {true, &appMessage{Offer: &offer{Message: ptr("hello, wormhole")}}},
+	"b70d41e8aa/2": {true, &appMessage{Answer: &answer{MessageAck: "ok"}}},
+	"1f3e6a09c2/3": {true, &appMessage{Offer: &offer{Directory: &directoryOffer{
+		Mode: zipMode, Dirname: "photos", Zipsize: 1024, Numbytes: 4096, Numfiles: 3,
+	}}}},
+	"b70d41e8aa/3": {true, &appMessage{Error: rejectMessage}},
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestTranscriptMessages(t *testing.T) {
+	tr := loadTranscript(t)
+	c := transcriptClient(t, tr)
+	for _, m := range tr.Messages {
+		if m.Phase == "pake" {
+			continue
+		}
+		want, ok := transcriptBodies[m.Side+"/"+m.Phase]
+		if !ok {
+			t.Fatalf("no expectation for %s/%s", m.Side, m.Phase)
+		}
+
+		// Decrypt it the way messages from the mailbox server are.
+		c.inbox[m.Phase] = mailbox.MessageMessage{Side: m.Side, Phase: m.Phase, Body: m.Body}
+		got := reflect.New(reflect.TypeOf(want.v).Elem()).Interface()
+		if err := c.receivePhase(t.Context(), m.Phase, got); err != nil {
+			t.Errorf("%s/%s: %v", m.Side, m.Phase, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want.v) {
+			t.Errorf("%s/%s: decoded %+v, want %+v", m.Side, m.Phase, got, want.v)
+		}
+
+		if !want.exact {
+			continue
+		}
+		encoded, err := json.Marshal(want.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameJSON(t, encoded, []byte(m.Plaintext)) {
+			t.Errorf("%s/%s: encoded %s, want %s", m.Side, m.Phase, encoded, m.Plaintext)
+		}
+	}
+}
+
+func TestTranscriptWrongKey(t *testing.T) {
+	tr := loadTranscript(t)
+	c := transcriptClient(t, tr)
+	c.key[0] ^= 1
+	m := tr.Messages[len(tr.Messages)-1]
+	c.inbox[m.Phase] = mailbox.MessageMessage{Side: m.Side, Phase: m.Phase, Body: m.Body}
+	var msg appMessage
+	if err := c.receivePhase(t.Context(), m.Phase, &msg); err != errDecrypt {
+		t.Fatalf("got %v, want errDecrypt", err)
+	}
+}
+
+// sameJSON reports whether a and b encode the same value.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,253 @@
+package wormhole
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+// Messages exchanged with the peer through the mailbox. They follow the
+// magic-wormhole file transfer protocol, so GoPipe can talk to the Python and
+// Rust clients.
+
+// pakeMessage is the body of the "pake" phase.
+type pakeMessage struct {
+	PakeV1 string `json:"pake_v1"` // hex encoded SPAKE2 message
+}
+
+// versionMessage is the body of the "version" phase. It is the first
+// message encrypted with the session key and doubles as key confirmation.
+type versionMessage struct {
+	AppVersions appVersions `json:"app_versions"`
+}
+
+// appVersions lets GoPipe peers discover each other's protocol extensions.
+// Other clients send an empty object, so every extension is optional.
+type appVersions struct {
+	GoPipe *gopipeVersion `json:"gopipe,omitempty"`
+}
+
+type gopipeVersion struct {
+	Abilities []string `json:"abilities"`
+	// Role is "sender" or "receiver". Older versions leave it out; for them
+	// the side that generated the code is always the sender.
+	Role string `json:"role,omitempty"`
+}
+
+// Protocol extensions understood by this version of GoPipe.
+const (
+	// abilityEOS: the transit stream ends with an end-of-stream record.
+	abilityEOS = "eos-v1"
+	// abilityDigest: the sender follows the data with a transferDigest
+	// record, which the receiver checks before acknowledging.
+	abilityDigest = "sha256-v1"
+	// abilityResume: file offers carry a content ID, and the answer may ask
+	// the sender to start at an offset. The sender of a file, directory or
+	// multi offer sends its hints only after the answer, once it has hashed
+	// what the receiver already has, so that neither side is waiting to
+	// connect meanwhile.
+	abilityResume = "resume-v1"
+	// abilityReconnect: a broken transit connection is replaced through
+	// reconnect messages instead of failing the transfer.
+	abilityReconnect = "reconnect-v1"
+	// abilityTar: directories may be sent as a tar stream and unpacked on
+	// arrival, keeping permissions, modification times and symlinks.
+	abilityTar = "tar-v1"
+	// abilityStream: a file offer may leave out the size. The data then runs
+	// up to the end-of-stream record, the last record before it being the
+	// digest.
+	abilityStream = "stream-v1"
+	// abilityMulti: several files and directories may be offered together,
+	// with a manifest, and sent as one tar stream.
+	abilityMulti = "multi-v1"
+	// abilitySession: the sender may offer a session, which keeps the
+	// transit connection open for transfers in both directions.
+	abilitySession = "session-v1"
+)
+
+var ourAbilities = []string{abilityEOS, abilityDigest, abilityResume, abilityReconnect, abilityTar, abilityStream, abilityMulti, abilitySession}
+
+// appMessage is the body of a numbered phase. Exactly one field is set.
+type appMessage struct {
+	Transit   *transit.TransitMessage `json:"transit,omitempty"`
+	Offer     *offer                  `json:"offer,omitempty"`
+	Answer    *answer                 `json:"answer,omitempty"`
+	Error     string                  `json:"error,omitempty"`
+	Reason    string                  `json:"reason,omitempty"` // why an offer was rejected
+	Reconnect *reconnectMessage       `json:"reconnect,omitempty"`
+}
+
+// reconnectMessage carries fresh hints after the transit connection broke.
+// Attempt counts the replacements, so both sides derive the same transit key
+// and stale messages can be told apart. The receiver sets Offset to the
+// number of bytes it has, which is where the sender continues.
+type reconnectMessage struct {
+	Attempt int            `json:"attempt"`
+	Hints   []transit.Hint `json:"hints-v1"`
+	Offset  int64          `json:"offset,omitempty"`
+}
+
+type offer struct {
+	Message   *string         `json:"message,omitempty"`
+	File      *fileOffer      `json:"file,omitempty"`
+	Directory *directoryOffer `json:"directory,omitempty"`
+	Files     *filesOffer     `json:"files,omitempty"`
+	Session   *sessionOffer   `json:"session,omitempty"`
+}
+
+type fileOffer struct {
+	Filename  string `json:"filename"`
+	Filesize  int64  `json:"filesize"` // zero for a stream
+	ContentID string `json:"content_id,omitempty"`
+	Stream    bool   `json:"stream,omitempty"` // the size is not known in advance
+}
+
+// directoryOffer describes a directory sent as an archive.
+type directoryOffer struct {
+	Mode     string `json:"mode"` // zipMode, or tarMode between GoPipe peers
+	Dirname  string `json:"dirname"`
+	Zipsize  int64  `json:"zipsize"` // size of the archive, whatever its mode
+	Numbytes int64  `json:"numbytes"`
+	Numfiles int    `json:"numfiles"`
+}
+
+// filesOffer describes several files and directories sent as one tar
+// stream, each at the top of the archive under its name.
+type filesOffer struct {
+	Entries  []manifestEntry `json:"entries"`
+	Size     int64           `json:"size"` // size of the archive
+	Numbytes int64           `json:"numbytes"`
+	Numfiles int             `json:"numfiles"`
+}
+
+type manifestEntry struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"` // "file" or "dir"
+	Numbytes int64  `json:"numbytes"`
+	Numfiles int    `json:"numfiles,omitempty"`
+}
+
+// sessionOffer asks the receiver to keep the transit connection open, see
+// Session. It has no options yet.
+type sessionOffer struct{}
+
+type answer struct {
+	FileAck    string `json:"file_ack,omitempty"`
+	MessageAck string `json:"message_ack,omitempty"`
+	SessionAck string `json:"session_ack,omitempty"`
+	Offset     int64  `json:"offset,omitempty"` // bytes of the file the receiver already has
+}
+
+// transferDigest follows the data when the receiver supports abilityDigest.
+type transferDigest struct {
+	SHA256 string `json:"sha256"`
+}
+
+// transferAck is the last record on the transit connection, sent by the
+// receiver once it has all the data. SHA256 is the hash of what it wrote.
+type transferAck struct {
+	Ack    string `json:"ack"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+const (
+	ackOK           = "ok"
+	ackHashMismatch = "hash-mismatch"
+)
+
+// sessionMessage is a control message of a session, sent on its stream 0.
+// ID is the transfer it is about; the side that opens a transfer picks it.
+type sessionMessage struct {
+	ID     uint32       `json:"id,omitempty"`
+	Offer  *offer       `json:"offer,omitempty"`
+	Answer *answer      `json:"answer,omitempty"`
+	Ack    *transferAck `json:"ack,omitempty"`
+	Error  string       `json:"error,omitempty"`  // the transfer is abandoned
+	Reason string       `json:"reason,omitempty"` // why an offer was rejected
+	Close  bool         `json:"close,omitempty"`  // the session ends
+}
+
+// rejectMessage is the error a receiver sends to decline an offer, as the
+// magic-wormhole clients do. GoPipe may add a reason for the sender to
+// show; other clients ignore it.
+const rejectMessage = "transfer rejected"
+
+// declined is ErrDeclined with the reason the receiver gave, if any.
+func declined(reason string) error {
+	if reason == "" {
+		return ErrDeclined
+	}
+	return fmt.Errorf("%w: %s", ErrDeclined, reason)
+}
+
+// Directory archive modes.
+const (
+	zipMode = "zipfile/deflated"
+	tarMode = "tar"
+)
+
+func offerFromMetadata(meta transit.Metadata) *offer {
+	if meta.Mode == "multi" {
+		fo := &filesOffer{Size: meta.Size, Numbytes: meta.RawSize, Numfiles: meta.Files}
+		for _, e := range meta.Entries {
+			fo.Entries = append(fo.Entries, manifestEntry{Name: e.Name, Kind: e.Mode, Numbytes: e.Size, Numfiles: e.Files})
+		}
+		return &offer{Files: fo}
+	}
+	if meta.Mode == "dir" {
+		return &offer{Directory: &directoryOffer{
+			Mode:     meta.Archive,
+			Dirname:  meta.Name,
+			Zipsize:  meta.Size,
+			Numbytes: meta.RawSize,
+			Numfiles: meta.Files,
+		}}
+	}
+	if meta.Size < 0 {
+		return &offer{File: &fileOffer{Filename: meta.Name, Stream: true}}
+	}
+	return &offer{File: &fileOffer{Filename: meta.Name, Filesize: meta.Size, ContentID: meta.ContentID}}
+}
+
+func metadataFromOffer(o *offer) (transit.Metadata, bool) {
+	switch {
+	case o.Session != nil:
+		return transit.Metadata{Name: "session", Mode: "session"}, true
+	case o.File != nil && o.File.Stream:
+		return transit.Metadata{Name: o.File.Filename, Size: -1, Mode: "file"}, true
+	case o.File != nil:
+		return transit.Metadata{Name: o.File.Filename, Size: o.File.Filesize, Mode: "file", ContentID: o.File.ContentID}, true
+	case o.Directory != nil && (o.Directory.Mode == zipMode || o.Directory.Mode == tarMode):
+		return transit.Metadata{
+			Name:    o.Directory.Dirname,
+			Size:    o.Directory.Zipsize,
+			Mode:    "dir",
+			Archive: o.Directory.Mode,
+			Files:   o.Directory.Numfiles,
+			RawSize: o.Directory.Numbytes,
+		}, true
+	case o.Files != nil && len(o.Files.Entries) > 0:
+		meta := transit.Metadata{
+			Name:    fmt.Sprintf("%d items", len(o.Files.Entries)),
+			Size:    o.Files.Size,
+			Mode:    "multi",
+			Archive: tarMode,
+			Files:   o.Files.Numfiles,
+			RawSize: o.Files.Numbytes,
+		}
+		seen := make(map[string]bool)
+		for _, e := range o.Files.Entries {
+			// Each entry is moved into the output directory under its
+			// name, so it must be a plain name, and only one of each.
+			if !filepath.IsLocal(e.Name) || strings.ContainsAny(e.Name, `/\`) || seen[e.Name] {
+				return transit.Metadata{}, false
+			}
+			seen[e.Name] = true
+			meta.Entries = append(meta.Entries, transit.Entry{Name: e.Name, Size: e.Numbytes, Mode: e.Kind, Files: e.Numfiles})
+		}
+		return meta, true
+	}
+	return transit.Metadata{}, false
+}
@@ -3,108 +3,663 @@ package wormhole
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/frostbyte57/GoPipe/internal/transit"
 )
 
+// Progress reports how far a transfer has got. For directories, Current and
+// Total count the bytes of the files in it rather than of the archive.
 type Progress struct {
 	Current int64
-	Total   int64
+	Total   int64 // -1 for a stream of unknown size
 	Ratio   float64
+	Rate    float64 // bytes per second since the connection was made
+
+	// Directories and multi-file sends only: the entry being transferred,
+	// how far along it is, and how many of the files are complete.
+	File        string
+	FileCurrent int64
+	FileTotal   int64
+	FilesDone   int
+	FilesTotal  int
+
+	// Reconnecting is set while a broken connection is being replaced. The
+	// other fields are zero then.
+	Reconnecting bool
+}
+
+// ratio is current/total, and 0 for a stream of unknown size.
+func ratio(current, total int64) float64 {
+	switch {
+	case total < 0:
+		return 0
+	case total == 0:
+		return 1
+	}
+	return float64(current) / float64(total)
+}
+
+// rate is the number of bytes per second of n bytes moved since start.
+func rate(n int64, start time.Time) float64 {
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / elapsed
+}
+
+// wireProgress reports progress as the bytes transferred of size.
+func wireProgress(size int64) func(int64) Progress {
+	return func(n int64) Progress {
+		return Progress{Current: n, Total: size, Ratio: ratio(n, size)}
+	}
 }
 
-// ReceiveFile receives a file from the sender.
-// It tracks progress via the provided channel.
-func (c *Client) ReceiveFile(ctx context.Context, outDir string, progressCh chan<- Progress) (string, error) {
-	conn, err := c.PerformTransfer(ctx)
+// pendingOffer is an offer that has been received but not answered yet.
+type pendingOffer struct {
+	t    *transit.Transit        // nil for text messages
+	peer *transit.TransitMessage // nil until the sender's hints arrive
+	meta transit.Metadata
+	text string
+}
+
+// ReceiveOffer waits for the sender's offer and returns what it describes,
+// without answering it. Accept the offer with ReceiveFile, or ReceiveText if
+// its Mode is "text" and AcceptSession if it is "session", or decline it
+// with RejectOffer.
+func (c *Client) ReceiveOffer(ctx context.Context) (meta transit.Metadata, err error) {
+	if err := c.receiveOffer(ctx); err != nil {
+		c.closeMailbox(moodFor(err))
+		return meta, err
+	}
+	return c.offer.meta, nil
+}
+
+// RejectOffer declines the offer returned by ReceiveOffer and ends the
+// session.
+func (c *Client) RejectOffer(ctx context.Context) error {
+	if c.offer == nil {
+		return errors.New("no offer to reject")
+	}
+	if c.offer.t != nil {
+		c.offer.t.Close()
+	}
+	c.offer = nil
+	err := c.sendMessage(ctx, appMessage{Error: rejectMessage})
+	c.closeMailbox(moodFor(nil))
+	return err
+}
+
+// receiveOffer waits for the sender's offer and keeps it in c.offer. For
+// files and directories it also starts listening for the sender and collects
+// its hints; text messages need no transit connection.
+func (c *Client) receiveOffer(ctx context.Context) error {
+	if c.offer != nil {
+		return nil
+	}
+
+	var peer *transit.TransitMessage
+	var off *offer
+	for off == nil {
+		msg, err := c.receiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch {
+		case msg.Error != "":
+			return c.peerError(msg.Error)
+		case msg.Transit != nil:
+			peer = msg.Transit
+		case msg.Offer != nil:
+			off = msg.Offer
+		}
+	}
+
+	if off.Message != nil {
+		text := *off.Message
+		c.offer = &pendingOffer{
+			meta: transit.Metadata{Mode: "text", Size: int64(len(text))},
+			text: text,
+		}
+		return nil
+	}
+	meta, ok := metadataFromOffer(off)
+	if !ok {
+		c.sendMessage(ctx, appMessage{Error: "unsupported offer"})
+		return fmt.Errorf("sender offered an unsupported transfer")
+	}
+
+	t, err := c.startTransit(ctx)
 	if err != nil {
+		return err
+	}
+	// The sender's hints usually come before the offer, but a sender that
+	// can resume sends a file's only once it has the answer.
+	if peer == nil && (meta.Mode == "session" || !c.peerCan(abilityResume)) {
+		if peer, err = c.awaitHints(ctx); err != nil {
+			t.Close()
+			return err
+		}
+	}
+	c.offer = &pendingOffer{t: t, peer: peer, meta: meta}
+	return nil
+}
+
+// awaitHints waits for the sender's connection hints.
+func (c *Client) awaitHints(ctx context.Context) (*transit.TransitMessage, error) {
+	for {
+		msg, err := c.receiveMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case msg.Error != "":
+			return nil, c.peerError(msg.Error)
+		case msg.Transit != nil:
+			return msg.Transit, nil
+		}
+	}
+}
+
+// ReceiveText accepts a text message offered by the sender and returns it,
+// waiting for the offer first unless ReceiveOffer was called.
+func (c *Client) ReceiveText(ctx context.Context) (_ string, err error) {
+	defer func() { c.closeMailbox(moodFor(err)) }()
+
+	if err := c.receiveOffer(ctx); err != nil {
+		return "", err
+	}
+	off := c.offer
+	c.offer = nil
+	if off.t != nil {
+		off.t.Close()
+		c.sendMessage(ctx, appMessage{Error: "receiver expected a text message"})
+		return "", fmt.Errorf("sender offered a %s, not a text message", off.meta.Mode)
+	}
+	if err := c.sendMessage(ctx, appMessage{Answer: &answer{MessageAck: "ok"}}); err != nil {
 		return "", err
 	}
-	defer conn.Close()
+	return off.text, nil
+}
+
+// ReceiveFile accepts the sender's offer and receives the file, waiting for
+// the offer first unless ReceiveOffer was called. It tracks progress via the
+// provided channel.
+func (c *Client) ReceiveFile(ctx context.Context, outDir string, progressCh chan<- Progress) (_ string, err error) {
+	defer func() { c.closeMailbox(moodFor(err)) }()
+
+	off, err := c.takeOffer(ctx)
+	if err != nil {
+		return "", err
+	}
+	d := &download{t: off.t, size: off.meta.Size, progressCh: progressCh}
+	defer d.close()
+
+	sk, err := openSink(outDir, off.meta)
+	if err != nil {
+		c.sendMessage(ctx, appMessage{Error: "receiver cannot write the " + sk.kind()})
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			sk.abort(err)
+		}
+	}()
+	d.part, d.hasher, d.w = sk.part, sk.hasher, sk.w
+	d.received, d.saved = sk.offset(), sk.offset()
+	d.progress = sk.progress
 
-	// Read Metadata Length
-	lenBuf := make([]byte, 4)
-	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+	// Decline what does not fit before accepting it, telling the sender why.
+	if err := sk.checkSpace(); err != nil {
+		c.sendMessage(ctx, appMessage{Error: rejectMessage, Reason: ErrNoSpace.Error()})
 		return "", err
 	}
-	metaLen := binary.BigEndian.Uint32(lenBuf)
 
-	// Read Metadata
-	metaBuf := make([]byte, metaLen)
-	if _, err := io.ReadFull(conn, metaBuf); err != nil {
+	defer func() { c.reportFailure(ctx, err) }()
+	digest, err := c.fetch(ctx, d, off.peer)
+	if err != nil {
+		return "", err
+	}
+	if err := sk.close(); err != nil {
 		return "", err
 	}
+	if progressCh != nil && sk.tree != nil {
+		progressCh <- sk.tree.progress()
+	}
 
-	var meta transit.Metadata
-	if err := json.Unmarshal(metaBuf, &meta); err != nil {
+	result := d.result(digest)
+	var saved string
+	if result.Ack == ackOK {
+		if saved, err = sk.finish(); err != nil {
+			return "", err
+		}
+	}
+	if err := d.ack(result); err != nil {
 		return "", err
 	}
 
-	// Determine Output Path
+	return saved, nil
+}
+
+// sink is where a received file or directory is written. Files go to a
+// .part file; tar archives are unpacked into a temporary directory as they
+// arrive.
+type sink struct {
+	outDir string
+	name   string // of the file or directory in outDir
+	meta   transit.Metadata
+	part   *partialDownload
+	tree   *treeDownload
+	hasher hash.Hash
+	w      *bufio.Writer // writes to the destination and hasher
+}
+
+func openSink(outDir string, meta transit.Metadata) (*sink, error) {
 	if outDir == "" {
 		outDir = "."
 	}
 	// Security: Sanitize filename to prevent path traversal
 	cleanName := filepath.Base(meta.Name)
-	if cleanName == "." || cleanName == string(filepath.Separator) {
+	if cleanName == "." || cleanName == ".." || cleanName == string(filepath.Separator) {
 		cleanName = "downloaded_file"
 	}
+	if meta.Archive == zipMode {
+		cleanName += ".zip"
+	}
+	if meta.Mode == "multi" {
+		// Only names the temporary directory; the entries keep their own.
+		cleanName = "gopipe"
+	}
+
+	s := &sink{outDir: outDir, name: cleanName, meta: meta}
+	var err error
+	if meta.Archive == tarMode {
+		if s.tree, err = startTreeDownload(outDir, cleanName, meta); err != nil {
+			return s, err
+		}
+		s.hasher = sha256.New()
+		// A small buffer keeps the progress of the unpacking up to date.
+		s.w = bufio.NewWriterSize(io.MultiWriter(s.tree, s.hasher), 1024*1024)
+		return s, nil
+	}
+	if s.part, err = openPartial(outDir, cleanName, meta); err != nil {
+		return s, err
+	}
+	s.hasher = s.part.hasher
+	s.w = bufio.NewWriterSize(io.MultiWriter(s.part.file, s.part.hasher), 64*1024*1024)
+	return s, nil
+}
+
+// kind names what the sink receives, for error messages.
+func (s *sink) kind() string {
+	if s.meta.Archive == tarMode {
+		return "directory"
+	}
+	return "file"
+}
+
+// offset is the number of bytes already received by an earlier attempt.
+func (s *sink) offset() int64 {
+	if s.part == nil {
+		return 0
+	}
+	return s.part.Offset()
+}
+
+// progress describes a transfer that has received n bytes.
+func (s *sink) progress(n int64) Progress {
+	if s.tree != nil {
+		return s.tree.progress()
+	}
+	return wireProgress(s.meta.Size)(n)
+}
 
-	outPath := filepath.Join(outDir, cleanName)
+// checkSpace returns ErrNoSpace if what is still to come does not fit into
+// the output directory.
+func (s *sink) checkSpace() error {
+	needed := s.meta.Size - s.offset()
+	if s.tree != nil {
+		needed = s.meta.RawSize
+	}
+	if free, err := freeSpace(s.outDir); err == nil && free < needed {
+		return fmt.Errorf("%w in %s: %d bytes needed, %d available", ErrNoSpace, s.outDir, needed, free)
+	}
+	return nil
+}
+
+// close waits until everything written has been unpacked. The caller
+// flushes w first.
+func (s *sink) close() error {
+	if s.tree == nil {
+		return nil
+	}
+	if err := s.tree.close(); err != nil {
+		return fmt.Errorf("unpacking %s: %w", s.meta.Name, err)
+	}
+	return nil
+}
 
-	// Auto-rename if exists
-	ext := filepath.Ext(cleanName)
-	nameOnly := cleanName[:len(cleanName)-len(ext)]
+// finish moves what was received into the output directory and returns the
+// names it was saved under.
+func (s *sink) finish() (string, error) {
+	if s.meta.Mode == "multi" {
+		names, err := s.tree.finishEntries(s.outDir, s.meta.Entries)
+		return strings.Join(names, ", "), err
+	}
+	outPath := uniquePath(s.outDir, s.name)
+	var err error
+	if s.tree != nil {
+		err = s.tree.finish(outPath)
+	} else {
+		err = s.part.finish(outPath)
+	}
+	return filepath.Base(outPath), err
+}
+
+// abort gives up on the transfer because of err. A broken transfer leaves
+// the .part file behind for the next attempt, unless the data already on
+// disk is known to be bad.
+func (s *sink) abort(err error) {
+	switch {
+	case s.tree != nil:
+		s.tree.abort()
+	case s.part != nil:
+		s.part.abort(!errors.Is(err, ErrHashMismatch))
+	}
+}
+
+// ReceiveStream accepts the sender's offer and writes what it receives to w
+// instead of a file, waiting for the offer first unless ReceiveOffer was
+// called. Directories arrive as the archive they are sent as. Data is
+// written as it arrives, so ErrHashMismatch may be returned after the
+// corrupted data has been written.
+func (c *Client) ReceiveStream(ctx context.Context, w io.Writer, progressCh chan<- Progress) (err error) {
+	defer func() { c.closeMailbox(moodFor(err)) }()
+
+	off, err := c.takeOffer(ctx)
+	if err != nil {
+		return err
+	}
+	d := &download{t: off.t, size: off.meta.Size, hasher: sha256.New(), progressCh: progressCh}
+	defer d.close()
+	d.w = bufio.NewWriterSize(io.MultiWriter(w, d.hasher), 1024*1024)
+	d.progress = wireProgress(off.meta.Size)
+
+	defer func() { c.reportFailure(ctx, err) }()
+	digest, err := c.fetch(ctx, d, off.peer)
+	if err != nil {
+		return err
+	}
+	return d.ack(d.result(digest))
+}
+
+// takeOffer waits for the offer unless ReceiveOffer was called, and takes
+// it for a file or directory transfer.
+func (c *Client) takeOffer(ctx context.Context) (*pendingOffer, error) {
+	if err := c.receiveOffer(ctx); err != nil {
+		return nil, err
+	}
+	off := c.offer
+	c.offer = nil
+	if off.t == nil {
+		c.sendMessage(ctx, appMessage{Error: "receiver cannot accept text messages"})
+		return nil, fmt.Errorf("sender offered a text message, not a file")
+	}
+	if off.meta.Mode == "session" {
+		off.t.Close()
+		c.sendMessage(ctx, appMessage{Error: "receiver cannot open a session"})
+		return nil, fmt.Errorf("sender offered a session, not a file")
+	}
+	return off, nil
+}
+
+// reportFailure tells the sender, who is waiting for us once the offer is
+// accepted, when we give up for a reason of our own.
+func (c *Client) reportFailure(ctx context.Context, err error) {
+	var linkErr *linkError
+	var pErr *peerError
+	if err != nil && !errors.As(err, &linkErr) && !errors.As(err, &pErr) &&
+		!errors.Is(err, ErrHashMismatch) && ctx.Err() == nil {
+		c.abort(ctx, err)
+	}
+}
+
+// fetch accepts the offer, connects to the sender and receives the data into
+// d, replacing the connection if it breaks. peer is nil if the sender's hints
+// follow the answer. The sender then waits for the ack on d.conn.
+func (c *Client) fetch(ctx context.Context, d *download, peer *transit.TransitMessage) (transferDigest, error) {
+	if err := c.sendMessage(ctx, appMessage{Answer: &answer{FileAck: "ok", Offset: d.received}}); err != nil {
+		return transferDigest{}, err
+	}
+	if peer == nil {
+		var err error
+		if peer, err = c.awaitHints(ctx); err != nil {
+			return transferDigest{}, err
+		}
+	}
+	conn, err := c.PerformTransfer(ctx, d.t, *peer)
+	if err != nil {
+		return transferDigest{}, err
+	}
+	d.conn = conn
+
+	// A stream cannot be sent again, so it cannot survive a broken
+	// connection.
+	digest, err := c.receiveData(ctx, d)
+	for d.size >= 0 && c.canReconnect(ctx, err) {
+		d.close()
+		if d.progressCh != nil {
+			d.progressCh <- Progress{Reconnecting: true}
+		}
+
+		t, conn, _, rErr := c.reconnect(ctx, d.received)
+		if rErr != nil {
+			var pErr *peerError
+			if errors.As(rErr, &pErr) {
+				return digest, rErr
+			}
+			return digest, fmt.Errorf("%w (%v)", err, rErr)
+		}
+		d.t, d.conn = t, conn
+		digest, err = c.receiveData(ctx, d)
+	}
+	if err != nil {
+		// Keep what arrived for a later attempt.
+		d.checkpoint()
+		return digest, err
+	}
+	return digest, d.w.Flush()
+}
+
+// uniquePath returns a path in dir for name that does not exist yet, adding
+// " (1)", " (2)", ... before the extension as needed.
+func uniquePath(dir, name string) string {
+	outPath := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	nameOnly := name[:len(name)-len(ext)]
 	counter := 1
 	for {
 		if _, err := os.Stat(outPath); os.IsNotExist(err) {
-			break
+			return outPath
 		}
-		outPath = filepath.Join(outDir, fmt.Sprintf("%s (%d)%s", nameOnly, counter, ext))
+		outPath = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", nameOnly, counter, ext))
 		counter++
 	}
+}
 
-	out, err := os.Create(outPath)
-	if err != nil {
-		return "", err
+// download is the receiving side of a transfer, kept across reconnections.
+type download struct {
+	t          *transit.Transit
+	conn       *transit.EncryptedConn // nil until connected
+	part       *partialDownload       // nil unless saving to a file
+	w          *bufio.Writer          // writes to the destination and hasher
+	hasher     hash.Hash
+	size       int64 // -1 for a stream
+	received   int64 // bytes written to w
+	saved      int64 // bytes recorded in the journal
+	progress   func(received int64) Progress
+	progressCh chan<- Progress
+
+	// Where and when the current connection started, for the rate.
+	start     time.Time
+	startedAt int64
+}
+
+func (d *download) close() {
+	if d.conn != nil {
+		d.conn.Close()
+	}
+	d.t.Close()
+}
+
+// write passes p on to the destination.
+func (d *download) write(p []byte) error {
+	if _, err := d.w.Write(p); err != nil {
+		return err
+	}
+	d.received += int64(len(p))
+	if d.progressCh != nil {
+		progress := d.progress(d.received)
+		progress.Rate = rate(d.received-d.startedAt, d.start)
+		d.progressCh <- progress
+	}
+	if d.received-d.saved >= checkpointInterval {
+		return d.checkpoint()
+	}
+	return nil
+}
+
+// checkpoint flushes everything received so far and records it in the
+// journal.
+func (d *download) checkpoint() error {
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	d.saved = d.received
+	if d.part == nil {
+		return nil
 	}
-	defer out.Close()
+	return d.part.checkpoint(d.received)
+}
 
-	outWriter := bufio.NewWriterSize(out, 64*1024*1024)
-	defer outWriter.Flush()
+// result compares what was received with the sender's digest.
+func (d *download) result(digest transferDigest) transferAck {
+	sum := hex.EncodeToString(d.hasher.Sum(nil))
+	result := transferAck{Ack: ackOK, SHA256: sum}
+	if digest.SHA256 != "" && digest.SHA256 != sum {
+		result.Ack = ackHashMismatch
+	}
+	return result
+}
 
-	var received int64
+// ack sends result to the sender. A mismatch is returned as ErrHashMismatch.
+func (d *download) ack(result transferAck) error {
+	ack, _ := json.Marshal(result)
+	if err := d.conn.WriteRecord(ack); err != nil {
+		return err
+	}
+	if result.Ack == ackHashMismatch {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// receiveData reads the rest of the stream into d, then the sender's digest
+// and the end-of-stream record. Failures of the connection are returned as
+// *linkError. If ctx is done, the connection is closed and ctx.Err()
+// returned.
+func (c *Client) receiveData(ctx context.Context, d *download) (digest transferDigest, err error) {
+	defer stopOnCancel(ctx, d.conn, &err)()
+
+	d.start, d.startedAt = time.Now(), d.received
+	if d.size < 0 {
+		return c.receiveStream(d)
+	}
+
+	conn := d.conn
 	buf := make([]byte, 1024*1024)
-	for {
+	for d.received < d.size {
+		c.keepAlive(conn)
 		n, rErr := conn.Read(buf)
+		if d.received+int64(n) > d.size {
+			return digest, fmt.Errorf("sender sent more data than offered")
+		}
 		if n > 0 {
-			_, wErr := outWriter.Write(buf[:n])
-			if wErr != nil {
-				return "", wErr
-			}
-			received += int64(n)
-			if meta.Size > 0 && progressCh != nil {
-				ratio := float64(received) / float64(meta.Size)
-				progressCh <- Progress{
-					Current: received,
-					Total:   meta.Size,
-					Ratio:   ratio,
-				}
+			if err := d.write(buf[:n]); err != nil {
+				return digest, err
 			}
 		}
 		if rErr == io.EOF {
-			break
+			return digest, fmt.Errorf("sender ended the stream after %d of %d bytes", d.received, d.size)
 		}
 		if rErr != nil {
-			return "", rErr
+			return digest, asLinkError(fmt.Errorf("after %d of %d bytes: %w", d.received, d.size, rErr))
+		}
+	}
+
+	c.keepAlive(conn)
+	if c.peerCan(abilityDigest) {
+		record, err := conn.ReadRecord()
+		if err != nil {
+			return digest, asLinkError(fmt.Errorf("waiting for the sender's digest: %w", err))
+		}
+		if err := json.Unmarshal(record, &digest); err != nil || digest.SHA256 == "" {
+			return digest, fmt.Errorf("invalid digest from sender")
+		}
+	}
+	if c.peerCan(abilityEOS) {
+		if _, err := conn.ReadRecord(); err != io.EOF {
+			if err == nil {
+				return digest, fmt.Errorf("sender sent more data than offered")
+			}
+			return digest, asLinkError(err)
+		}
+	}
+	return digest, nil
+}
+
+// receiveStream reads a stream of unknown size, which runs up to the
+// end-of-stream record. The last record before it is the sender's digest,
+// so every record is held back until the next one has arrived.
+func (c *Client) receiveStream(d *download) (transferDigest, error) {
+	var digest transferDigest
+	var held []byte
+	for {
+		c.keepAlive(d.conn)
+		record, err := d.conn.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return digest, asLinkError(fmt.Errorf("after %d bytes: %w", d.received, err))
 		}
+		if held != nil {
+			if err := d.write(held); err != nil {
+				return digest, err
+			}
+		}
+		held = record
 	}
 
-	return filepath.Base(outPath), nil
+	if !c.peerCan(abilityDigest) {
+		if held == nil {
+			return digest, nil
+		}
+		return digest, d.write(held)
+	}
+	if held == nil || json.Unmarshal(held, &digest) != nil || digest.SHA256 == "" {
+		return digest, fmt.Errorf("invalid digest from sender")
+	}
+	return digest, nil
 }
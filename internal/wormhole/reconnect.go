@@ -0,0 +1,198 @@
+package wormhole
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"time"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+const (
+	// transferIdleTimeout is how long a transfer may stall before the
+	// connection is considered dead and replaced.
+	transferIdleTimeout = 30 * time.Second
+	// reconnectTimeout bounds the time spent replacing a connection.
+	reconnectTimeout = 2 * time.Minute
+)
+
+// linkError is a failure of the transit connection itself, as opposed to a
+// problem with the data sent over it. The transfer can go on over a new
+// connection.
+type linkError struct {
+	err error
+}
+
+func (e *linkError) Error() string { return e.err.Error() }
+func (e *linkError) Unwrap() error { return e.err }
+
+// asLinkError marks err as a linkError if the connection broke, timed out or
+// was closed by the peer.
+func asLinkError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &linkError{err: err}
+	}
+	return err
+}
+
+// canReconnect reports whether err can be recovered from by replacing the
+// transit connection.
+func (c *Client) canReconnect(ctx context.Context, err error) bool {
+	var le *linkError
+	return errors.As(err, &le) && c.peerCan(abilityReconnect) && ctx.Err() == nil
+}
+
+// keepAlive moves the connection's deadline forward. It is called before
+// every read and write, so a connection that died silently is noticed.
+func (c *Client) keepAlive(conn *transit.EncryptedConn) {
+	if c.peerCan(abilityReconnect) {
+		conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+	}
+}
+
+// stopOnCancel closes conn once ctx is done, so that a transfer blocked
+// reading or writing it stops, and then reports ctx.Err() in *err instead of
+// the broken connection. Defer the function it returns.
+func stopOnCancel(ctx context.Context, conn *transit.EncryptedConn, err *error) func() {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return func() {
+		stop()
+		if *err != nil && ctx.Err() != nil {
+			*err = ctx.Err()
+		}
+	}
+}
+
+// reconnect replaces a broken transit connection. If the peer gave up on the
+// transfer instead, its error message is returned. Both sides send fresh
+// hints over the mailbox; the receiver passes the number of bytes it has,
+// which is returned to the sender as the offset to continue from.
+func (c *Client) reconnect(ctx context.Context, offset int64) (*transit.Transit, *transit.EncryptedConn, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, reconnectTimeout)
+	defer cancel()
+
+	c.attempt++
+	var peer *reconnectMessage
+	for {
+		t, hints, err := c.listen()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		msg := &reconnectMessage{Attempt: c.attempt, Hints: hints}
+		if !c.isSender {
+			msg.Offset = offset
+		}
+		if err := c.sendMessage(ctx, appMessage{Reconnect: msg}); err != nil {
+			t.Close()
+			return nil, nil, 0, err
+		}
+
+		for peer == nil || peer.Attempt < c.attempt {
+			m, err := c.receiveMessage(ctx)
+			if err != nil {
+				t.Close()
+				return nil, nil, 0, fmt.Errorf("reconnecting: %w", err)
+			}
+			if m.Error != "" {
+				t.Close()
+				return nil, nil, 0, c.peerError(m.Error)
+			}
+			if m.Reconnect != nil {
+				peer = m.Reconnect
+			}
+		}
+		if peer.Attempt > c.attempt {
+			// The peer already gave up on this attempt; follow it.
+			t.Close()
+			c.attempt = peer.Attempt
+			continue
+		}
+
+		conn, err := c.PerformTransfer(ctx, t, transit.TransitMessage{Hints: peer.Hints})
+		if err != nil {
+			t.Close()
+			if ctx.Err() != nil {
+				return nil, nil, 0, fmt.Errorf("reconnecting: %w", err)
+			}
+			c.attempt++
+			continue
+		}
+		if c.isSender {
+			offset = peer.Offset
+		}
+		return t, conn, offset, nil
+	}
+}
+
+// markedHash is the SHA-256 of a stream that keeps its state at every
+// checkpointInterval bytes, so that the hash can later be taken up again
+// from any of these marks rather than from the start.
+type markedHash struct {
+	hash.Hash
+	n     int64            // bytes of the stream hashed
+	marks map[int64][]byte // the state of the hash by position
+}
+
+func newMarkedHash() *markedHash {
+	return &markedHash{Hash: sha256.New(), marks: make(map[int64][]byte)}
+}
+
+func (m *markedHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if next := checkpointInterval - m.n%checkpointInterval; int64(len(chunk)) > next {
+			chunk = chunk[:next]
+		}
+		m.Hash.Write(chunk)
+		m.n += int64(len(chunk))
+		p = p[len(chunk):]
+		if m.n%checkpointInterval == 0 {
+			if state, err := m.Hash.(encoding.BinaryMarshaler).MarshalBinary(); err == nil {
+				m.marks[m.n] = state
+			}
+		}
+	}
+	return written, nil
+}
+
+// rewind positions the reader at offset and brings the hasher to the hash of
+// everything before it. The bytes are read rather than skipped, so the
+// digest sent at the end still covers the whole stream; only those after
+// the last mark at or before offset need to be read again.
+func (u *upload) rewind(offset int64) error {
+	s, ok := u.reader.(io.Seeker)
+	if !ok {
+		return errors.New("stream cannot be rewound")
+	}
+	marks := make(map[int64][]byte)
+	if u.hasher != nil {
+		marks = u.hasher.marks
+	}
+	h := &markedHash{Hash: sha256.New(), marks: marks}
+	for from := offset - offset%checkpointInterval; from > 0; from -= checkpointInterval {
+		if state, ok := marks[from]; ok {
+			if err := h.Hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err == nil {
+				h.n = from
+				break
+			}
+			h.Hash.Reset()
+		}
+	}
+
+	if _, err := s.Seek(h.n, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(h, u.reader, offset-h.n); err != nil {
+		return err
+	}
+	u.hasher = h
+	return nil
+}
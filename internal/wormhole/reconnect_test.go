@@ -0,0 +1,116 @@
+package wormhole
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	*bytes.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func TestUploadRewind(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), (checkpointInterval+4096)/16)
+	r := &countingReader{Reader: bytes.NewReader(data)}
+	u := &upload{reader: r}
+	if err := u.rewind(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send everything, as sendData does.
+	if _, err := io.Copy(u.hasher, r); err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(data); !bytes.Equal(u.hasher.Sum(nil), want[:]) {
+		t.Fatal("hash of the whole stream is wrong")
+	}
+
+	// A reconnection past the mark only reads again what follows it.
+	offset := int64(checkpointInterval + 1000)
+	r.n = 0
+	if err := u.rewind(offset); err != nil {
+		t.Fatal(err)
+	}
+	if r.n != 1000 {
+		t.Errorf("rewinding read %d bytes, want 1000", r.n)
+	}
+	if want := sha256.Sum256(data[:offset]); !bytes.Equal(u.hasher.Sum(nil), want[:]) {
+		t.Error("hash of the prefix is wrong")
+	}
+	if _, err := io.Copy(u.hasher, r); err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(data); !bytes.Equal(u.hasher.Sum(nil), want[:]) {
+		t.Error("hash of the whole stream is wrong after rewinding")
+	}
+
+	// Before the first mark, the stream is read again from the start.
+	r.n = 0
+	if err := u.rewind(500); err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(data[:500]); r.n != 500 || !bytes.Equal(u.hasher.Sum(nil), want[:]) {
+		t.Errorf("rewinding to 500 read %d bytes or hashed wrong", r.n)
+	}
+}
+
+func TestUploadRewindTar(t *testing.T) {
+	dir := t.TempDir()
+	big := filepath.Join(dir, "a.bin")
+	if err := os.WriteFile(big, []byte("start"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(big, checkpointInterval); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), bytes.Repeat([]byte("tail "), 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stream, _, err := prepareTarStream(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var archive bytes.Buffer
+	if err := writeTar(&archive, stream.(*tarStream).entries); err != nil {
+		t.Fatal(err)
+	}
+	data := archive.Bytes()
+
+	u := &upload{reader: stream}
+	if err := u.rewind(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(u.hasher, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// Past the mark, in the second file's header and then in its contents.
+	for _, offset := range []int64{checkpointInterval + 700, checkpointInterval + 1700, 1000} {
+		if err := u.rewind(offset); err != nil {
+			t.Fatalf("rewinding to %d: %v", offset, err)
+		}
+		if want := sha256.Sum256(data[:offset]); !bytes.Equal(u.hasher.Sum(nil), want[:]) {
+			t.Errorf("hash of the first %d bytes is wrong", offset)
+		}
+		rest, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, data[offset:]) {
+			t.Errorf("after rewinding to %d, the stream differs from the archive", offset)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package wormhole
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+// Downloads are written to "<name>.part", or to "<name>.<random>.part" if
+// they cannot be resumed. When the sender supports resuming, a journal next
+// to it ("<name>.part.json") records how much of the file has been received
+// and the SHA-256 of that prefix, so a later session offering the same
+// content can pick up where this one stopped.
+
+const (
+	partSuffix    = ".part"
+	journalSuffix = ".part.json"
+
+	// checkpointInterval is how often the journal is brought up to date.
+	checkpointInterval = 64 * 1024 * 1024
+)
+
+type journal struct {
+	ContentID string `json:"content_id"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	SHA256    string `json:"sha256"` // of the first Offset bytes
+}
+
+// contentID identifies a file across sessions without reading it. Changing
+// the file's name, size or modification time gives it a new ID.
+func contentID(info os.FileInfo) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", info.Name(), info.Size(), info.ModTime().UnixNano())
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// partialDownload is a file being received. hasher holds the SHA-256 of
+// everything written to file so far.
+type partialDownload struct {
+	path        string
+	journalPath string
+	file        *os.File
+	hasher      hash.Hash
+	journal     journal
+}
+
+// openPartial opens the .part file for meta in dir. If the journal shows an
+// earlier attempt at the same content, the file is positioned after the part
+// already received; otherwise it starts out empty. An offer that cannot be
+// resumed gets a .part file of its own, so it never truncates that of
+// another transfer of the same name.
+func openPartial(dir, name string, meta transit.Metadata) (*partialDownload, error) {
+	p := &partialDownload{
+		hasher:  sha256.New(),
+		journal: journal{ContentID: meta.ContentID, Name: meta.Name, Size: meta.Size},
+	}
+	if !p.resumable() {
+		f, err := os.CreateTemp(dir, name+".*"+partSuffix)
+		if err != nil {
+			return nil, err
+		}
+		p.path, p.file = f.Name(), f
+		return p, nil
+	}
+
+	p.path = filepath.Join(dir, name+partSuffix)
+	p.journalPath = filepath.Join(dir, name+journalSuffix)
+	if err := p.resume(); err == nil {
+		return p, nil
+	}
+	p.hasher.Reset()
+	f, err := os.Create(p.path)
+	if err != nil {
+		return nil, err
+	}
+	p.file = f
+	return p, nil
+}
+
+// resume checks the journal against the offer and the .part file. The prefix
+// is hashed again, so a .part file changed since the journal was written is
+// never trusted.
+func (p *partialDownload) resume() error {
+	data, err := os.ReadFile(p.journalPath)
+	if err != nil {
+		return err
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.ContentID != p.journal.ContentID || j.Name != p.journal.Name || j.Size != p.journal.Size ||
+		j.Offset <= 0 || j.Offset > j.Size {
+		return errors.New("journal is for different content")
+	}
+
+	f, err := os.OpenFile(p.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	// Reading the prefix also leaves f positioned at the offset.
+	if _, err := io.CopyN(p.hasher, f, j.Offset); err != nil {
+		f.Close()
+		return err
+	}
+	if hex.EncodeToString(p.hasher.Sum(nil)) != j.SHA256 {
+		f.Close()
+		return errors.New("partial file does not match its journal")
+	}
+	if err := f.Truncate(j.Offset); err != nil {
+		f.Close()
+		return err
+	}
+
+	p.file = f
+	p.journal = j
+	return nil
+}
+
+func (p *partialDownload) resumable() bool {
+	return p.journal.ContentID != ""
+}
+
+// Offset returns the number of bytes already in the file.
+func (p *partialDownload) Offset() int64 {
+	return p.journal.Offset
+}
+
+// checkpoint records that the first offset bytes are on disk. The caller
+// must have flushed everything up to offset to the file and the hasher.
+func (p *partialDownload) checkpoint(offset int64) error {
+	if !p.resumable() {
+		return nil
+	}
+	p.journal.Offset = offset
+	p.journal.SHA256 = hex.EncodeToString(p.hasher.Sum(nil))
+	data, err := json.Marshal(p.journal)
+	if err != nil {
+		return err
+	}
+
+	// Replace the journal atomically, so it is never half written.
+	tmp := p.journalPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.journalPath)
+}
+
+// finish moves the completed file to outPath and drops the journal.
+func (p *partialDownload) finish(outPath string) error {
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p.path, outPath); err != nil {
+		return err
+	}
+	if p.resumable() {
+		os.Remove(p.journalPath)
+	}
+	return nil
+}
+
+// abort closes the file. It is kept for a later attempt if keep is set and
+// the transfer can be resumed, and removed otherwise.
+func (p *partialDownload) abort(keep bool) {
+	p.file.Close()
+	if !p.resumable() {
+		os.Remove(p.path)
+		return
+	}
+	if keep && p.journal.Offset > 0 {
+		return
+	}
+	os.Remove(p.path)
+	os.Remove(p.journalPath)
+}
@@ -0,0 +1,42 @@
+package wormhole
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+func TestOpenPartialNotResumable(t *testing.T) {
+	dir := t.TempDir()
+	meta := transit.Metadata{Name: "data.bin", Size: 10, Mode: "file"}
+
+	// Another transfer of a file with the same name is under way.
+	other := filepath.Join(dir, "data.bin"+partSuffix)
+	if err := os.WriteFile(other, []byte("in progress"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := openPartial(dir, "data.bin", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := openPartial(dir, "data.bin", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.path == other || b.path == other || a.path == b.path {
+		t.Fatalf("part files %s and %s clash with %s", a.path, b.path, other)
+	}
+	a.abort(true)
+	b.abort(true)
+
+	if data, err := os.ReadFile(other); err != nil || string(data) != "in progress" {
+		t.Errorf("the other transfer's part file was changed: %q, %v", data, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("aborted part files left behind: %v", entries)
+	}
+}
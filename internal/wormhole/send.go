@@ -2,13 +2,16 @@ package wormhole
 
 import (
 	"archive/zip"
-	"bufio"
 	"context"
-	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/frostbyte57/GoPipe/internal/transit"
 )
@@ -16,152 +19,518 @@ import (
 // SendFile sends a file or directory to the receiver.
 // It tracks progress via the provided channel.
 func (c *Client) SendFile(ctx context.Context, filePath string, progressCh chan<- Progress) error {
-	conn, err := c.PerformTransfer(ctx)
+	return c.SendFiles(ctx, []string{filePath}, progressCh)
+}
+
+// SendFiles sends several files and directories in one transfer. The
+// receiver gets them side by side, each under its own name; base names that
+// occur more than once are made unique. Receivers that cannot take several
+// at once get them as a zipped directory.
+func (c *Client) SendFiles(ctx context.Context, paths []string, progressCh chan<- Progress) (err error) {
+	defer func() { c.closeMailbox(moodFor(err)) }()
+
+	reader, meta, err := c.openSource(paths)
 	if err != nil {
+		c.abort(ctx, err)
 		return err
 	}
-	defer conn.Close()
+	defer reader.Close()
+	return c.send(ctx, reader, meta, progressCh)
+}
+
+// openSource prepares paths for sending in the way the peer understands
+// best.
+func (c *Client) openSource(paths []string) (io.ReadCloser, transit.Metadata, error) {
+	if len(paths) == 1 {
+		archive := zipMode
+		if c.peerCan(abilityTar) {
+			archive = tarMode
+		}
+		reader, meta, err := prepareStream(paths[0], archive)
+		if !c.peerCan(abilityResume) {
+			meta.ContentID = ""
+		}
+		return reader, meta, err
+	}
 
-	reader, size, name, mode, err := prepareStream(filePath)
+	roots, err := multiRoots(paths)
 	if err != nil {
-		return err
+		return nil, transit.Metadata{}, err
+	}
+	if c.peerCan(abilityMulti) && c.peerCan(abilityTar) {
+		return prepareMultiTar(roots)
+	}
+	return prepareDirectoryStream("gopipe-files", roots)
+}
+
+// multiRoots names each of paths after its base name, adding " (1)",
+// " (2)", ... to repeated ones. Symlinks given directly are followed.
+func multiRoots(paths []string) ([]treeRoot, error) {
+	var roots []treeRoot
+	used := make(map[string]bool)
+	for _, path := range paths {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return nil, err
+		}
+		base := filepath.Base(filepath.Clean(path))
+		if base == "." || base == ".." || base == string(filepath.Separator) {
+			base = filepath.Base(resolved)
+		}
+		name := base
+		ext := filepath.Ext(base)
+		for i := 1; used[name]; i++ {
+			name = fmt.Sprintf("%s (%d)%s", base[:len(base)-len(ext)], i, ext)
+		}
+		used[name] = true
+		roots = append(roots, treeRoot{path: resolved, name: name})
+	}
+	return roots, nil
+}
+
+// ExpandPaths expands the glob patterns among paths, for shells that leave
+// them alone. Paths that exist as given are kept as they are, and a pattern
+// that matches nothing is an error.
+func ExpandPaths(paths []string) ([]string, error) {
+	var out []string
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err == nil {
+			out = append(out, path)
+			continue
+		}
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no such file or directory", path)
+		}
+		out = append(out, matches...)
+	}
+	return out, nil
+}
+
+// SplitPaths splits typed input into paths at spaces. Quotes and
+// backslashes keep spaces in a path, as in a shell, so paths dropped into a
+// terminal work.
+func SplitPaths(s string) []string {
+	var paths []string
+	var cur strings.Builder
+	var quote rune
+	inPath, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			cur.WriteRune(r)
+		case r == '\\' && os.PathSeparator != '\\':
+			escaped, inPath = true, true
+			continue
+		case r == '\'' || r == '"':
+			quote, inPath = r, true
+			continue
+		case r == ' ' || r == '\t':
+			if inPath {
+				paths = append(paths, cur.String())
+				cur.Reset()
+				inPath = false
+			}
+			continue
+		default:
+			cur.WriteRune(r)
+		}
+		inPath = true
+	}
+	if inPath {
+		paths = append(paths, cur.String())
+	}
+	return paths
+}
+
+// SendStream sends everything read from r, up to EOF, to the receiver as a
+// file called name. The size need not be known in advance, and Progress.Total
+// is -1. Receivers other than GoPipe need the size up front, so for them r is
+// first copied to a temporary file.
+func (c *Client) SendStream(ctx context.Context, name string, r io.Reader, progressCh chan<- Progress) (err error) {
+	defer func() { c.closeMailbox(moodFor(err)) }()
+
+	meta := transit.Metadata{Name: name, Size: -1, Mode: "file"}
+	if !c.peerCan(abilityStream) {
+		spool, err := spoolStream(r)
+		if err != nil {
+			err = &sourceError{name: name, err: err}
+			c.abort(ctx, err)
+			return err
+		}
+		defer spool.Close()
+		r = spool
+		if meta.Size, err = spool.Seek(0, io.SeekEnd); err == nil {
+			_, err = spool.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.send(ctx, r, meta, progressCh)
+}
+
+// spoolStream copies r to a temporary file, which is removed when closed.
+func spoolStream(r io.Reader) (*tempFile, error) {
+	tmp, err := os.CreateTemp("", "gopipe-*")
+	if err != nil {
+		return nil, err
 	}
-	// reader is responsible for closing underlying files if any, but io.PipeReader doesn't need explicit close if the writer closes,
-	// however os.File does.
-	// We need to handle cleanup.
-	if closer, ok := reader.(io.Closer); ok {
-		defer closer.Close()
+	spool := &tempFile{File: tmp}
+	if _, err := io.Copy(tmp, r); err != nil {
+		spool.Close()
+		return nil, err
 	}
+	return spool, nil
+}
 
-	// Send Metadata
-	meta := transit.Metadata{
-		Name: name,
-		Size: size,
-		Mode: mode,
+// send offers meta to the receiver and sends reader once it accepts. A
+// negative meta.Size is a stream, which cannot be resumed or rewound.
+func (c *Client) send(ctx context.Context, reader io.Reader, meta transit.Metadata, progressCh chan<- Progress) (err error) {
+	// Tell the receiver when we cannot go on, instead of just vanishing.
+	defer func() {
+		var srcErr *sourceError
+		if errors.As(err, &srcErr) {
+			c.abort(ctx, err)
+		}
+	}()
+	stream := meta.Size < 0
+
+	var t *transit.Transit
+	defer func() {
+		if t != nil {
+			t.Close()
+		}
+	}()
+	// Receivers that can resume take our hints after the answer, see
+	// abilityResume.
+	lateHints := c.peerCan(abilityResume)
+	if !lateHints {
+		if t, err = c.startTransit(ctx); err != nil {
+			return err
+		}
 	}
-	metaBytes, _ := json.Marshal(meta)
 
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(metaBytes)))
+	if err := c.sendMessage(ctx, appMessage{Offer: offerFromMetadata(meta)}); err != nil {
+		return err
+	}
 
-	if _, err := conn.Write(lenBuf); err != nil {
+	peer, ans, err := c.awaitAnswer(ctx)
+	if err != nil {
 		return err
 	}
-	if _, err := conn.Write(metaBytes); err != nil {
+	if ans.FileAck != "ok" {
+		return ErrDeclined
+	}
+	offset := ans.Offset
+	if offset < 0 || (!stream && offset > meta.Size) || (offset > 0 && meta.ContentID == "") {
+		return fmt.Errorf("receiver asked to resume at an invalid offset %d", offset)
+	}
+
+	u := &upload{
+		reader:     reader,
+		name:       meta.Name,
+		size:       meta.Size,
+		progressCh: progressCh,
+		progress:   wireProgress(meta.Size),
+	}
+	if ts, ok := reader.(*tarStream); ok {
+		u.progress = ts.progress
+	}
+	// When resuming, the receiver already has the first offset bytes.
+	if stream {
+		u.hasher = newMarkedHash()
+	} else if err := u.rewind(offset); err != nil {
+		return err
+	}
+	if lateHints {
+		if t, err = c.startTransit(ctx); err != nil {
+			return err
+		}
+	}
+
+	conn, err := c.PerformTransfer(ctx, t, peer)
+	if err != nil {
 		return err
 	}
+	defer func() { conn.Close() }()
 
-	// Transfer Data
-	bufReader := bufio.NewReaderSize(reader, 64*1024*1024)
-	buf := make([]byte, 1024*1024)
-	var current int64
+	err = c.sendData(ctx, conn, u, offset)
+	for !stream && c.canReconnect(ctx, err) {
+		conn.Close()
+		t.Close()
+		if progressCh != nil {
+			progressCh <- Progress{Reconnecting: true}
+		}
 
+		newT, newConn, resumeAt, rErr := c.reconnect(ctx, 0)
+		if rErr != nil {
+			var pErr *peerError
+			if errors.As(rErr, &pErr) {
+				return rErr
+			}
+			return fmt.Errorf("%w (%v)", err, rErr)
+		}
+		t, conn, offset = newT, newConn, resumeAt
+		if offset < 0 || offset > meta.Size {
+			return fmt.Errorf("receiver asked to resume at an invalid offset %d", offset)
+		}
+		if err := u.rewind(offset); err != nil {
+			return err
+		}
+		err = c.sendData(ctx, conn, u, offset)
+	}
+	return err
+}
+
+// awaitAnswer waits for the receiver's hints and its answer to our offer.
+// A declined offer is returned as ErrDeclined.
+func (c *Client) awaitAnswer(ctx context.Context) (transit.TransitMessage, answer, error) {
+	var peer *transit.TransitMessage
+	var ans *answer
+	for peer == nil || ans == nil {
+		msg, err := c.receiveMessage(ctx)
+		if err != nil {
+			return transit.TransitMessage{}, answer{}, err
+		}
+		switch {
+		case msg.Error == rejectMessage:
+			return transit.TransitMessage{}, answer{}, declined(msg.Reason)
+		case msg.Error != "":
+			return transit.TransitMessage{}, answer{}, c.peerError(msg.Error)
+		case msg.Transit != nil:
+			peer = msg.Transit
+		case msg.Answer != nil:
+			ans = msg.Answer
+		}
+	}
+	return *peer, *ans, nil
+}
+
+// SendText sends a text message to the receiver. The message travels
+// through the mailbox, encrypted like every other phase, so no transit
+// connection is made.
+func (c *Client) SendText(ctx context.Context, text string) (err error) {
+	defer func() { c.closeMailbox(moodFor(err)) }()
+
+	if err := c.sendMessage(ctx, appMessage{Offer: &offer{Message: &text}}); err != nil {
+		return err
+	}
 	for {
-		n, err := bufReader.Read(buf)
+		msg, err := c.receiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch {
+		case msg.Error == rejectMessage:
+			return declined(msg.Reason)
+		case msg.Error != "":
+			return c.peerError(msg.Error)
+		case msg.Answer != nil:
+			if msg.Answer.MessageAck != "ok" {
+				return ErrDeclined
+			}
+			return nil
+		}
+	}
+}
+
+// upload is the sending side of a transfer, kept across reconnections.
+type upload struct {
+	reader     io.Reader   // positioned where the next sendData starts
+	hasher     *markedHash // hash of everything before that
+	name       string
+	size       int64
+	progress   func(sent int64) Progress
+	progressCh chan<- Progress
+	buf        []byte // read into by sendData, kept for reconnections
+}
+
+// sendData sends the stream from offset on, followed by the digest and the
+// end-of-stream record, and waits for the receiver to confirm. Failures of
+// the connection are returned as *linkError, and failures to read the
+// stream as *sourceError. If ctx is done, the connection is closed and
+// ctx.Err() returned.
+func (c *Client) sendData(ctx context.Context, conn *transit.EncryptedConn, u *upload, offset int64) (err error) {
+	defer stopOnCancel(ctx, conn, &err)()
+
+	if u.buf == nil {
+		u.buf = make([]byte, 1024*1024)
+	}
+	buf := u.buf
+	reader := io.TeeReader(u.reader, u.hasher)
+	current := offset
+	start := time.Now()
+
+	for {
+		n, err := reader.Read(buf)
 		if n > 0 {
+			c.keepAlive(conn)
 			if _, wErr := conn.Write(buf[:n]); wErr != nil {
-				return wErr
+				return asLinkError(wErr)
 			}
 			current += int64(n)
-			if size > 0 && progressCh != nil {
-				progressCh <- Progress{
-					Current: current,
-					Total:   size,
-					Ratio:   float64(current) / float64(size),
-				}
+			if u.progressCh != nil {
+				progress := u.progress(current)
+				progress.Rate = rate(current-offset, start)
+				u.progressCh <- progress
 			}
 		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
+			var srcErr *sourceError
+			if !errors.As(err, &srcErr) {
+				err = &sourceError{name: u.name, err: err}
+			}
 			return err
 		}
 	}
+	if u.size >= 0 && current != u.size {
+		return &sourceError{name: u.name, err: errors.New("file changed while sending")}
+	}
+	sum := hex.EncodeToString(u.hasher.Sum(nil))
+	c.keepAlive(conn)
+	if c.peerCan(abilityDigest) {
+		digest, _ := json.Marshal(transferDigest{SHA256: sum})
+		if err := conn.WriteRecord(digest); err != nil {
+			return asLinkError(err)
+		}
+	}
+	// Only receivers that expect the end-of-stream record get it; to others
+	// it would be a stray record after the data.
+	if c.peerCan(abilityEOS) {
+		if err := conn.CloseWrite(); err != nil {
+			return asLinkError(err)
+		}
+	}
+
+	// The transfer only counts once the receiver confirms with the hash of
+	// what it wrote.
+	record, err := conn.ReadRecord()
+	if err != nil {
+		return asLinkError(fmt.Errorf("waiting for receiver to confirm: %w", err))
+	}
+	var ack transferAck
+	if err := json.Unmarshal(record, &ack); err != nil {
+		return fmt.Errorf("invalid confirmation from receiver: %w", err)
+	}
+	switch {
+	case ack.Ack == ackHashMismatch:
+		return ErrHashMismatch
+	case ack.Ack != ackOK:
+		return fmt.Errorf("transfer failed (receiver says %q)", ack.Ack)
+	case ack.SHA256 != "" && ack.SHA256 != sum:
+		return ErrHashMismatch
+	}
 
 	return nil
 }
 
-func prepareStream(path string) (io.Reader, int64, string, string, error) {
+// prepareStream opens path for sending. Directories are packed in the given
+// archive mode.
+func prepareStream(path string, archive string) (io.ReadCloser, transit.Metadata, error) {
 	info, err := os.Stat(path)
 	if err != nil {
-		return nil, 0, "", "", err
+		return nil, transit.Metadata{}, err
 	}
 
 	if info.IsDir() {
-		return prepareDirectoryStream(path)
+		if archive == tarMode {
+			return prepareTarStream(path)
+		}
+		return prepareDirectoryStream(filepath.Base(path), []treeRoot{{path: path}})
 	}
 	return prepareFileStream(path, info)
 }
 
-func prepareFileStream(path string, info os.FileInfo) (io.Reader, int64, string, string, error) {
+func prepareFileStream(path string, info os.FileInfo) (io.ReadCloser, transit.Metadata, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, 0, "", "", err
+		return nil, transit.Metadata{}, err
 	}
-	return f, info.Size(), info.Name(), "file", nil
+	return f, transit.Metadata{Name: info.Name(), Size: info.Size(), Mode: "file", ContentID: contentID(info)}, nil
 }
 
-func prepareDirectoryStream(path string) (io.Reader, int64, string, string, error) {
-	pr, pw := io.Pipe()
-	name := filepath.Base(path) + ".zip"
-	var size int64
+// prepareDirectoryStream zips the roots into a temporary file, since the
+// offer must state the exact size of the archive. For a single directory,
+// entries are named relative to the directory itself, as magic-wormhole
+// receivers expect.
+func prepareDirectoryStream(name string, roots []treeRoot) (io.ReadCloser, transit.Metadata, error) {
+	meta := transit.Metadata{Name: name, Mode: "dir", Archive: zipMode}
+
+	tmp, err := os.CreateTemp("", "gopipe-*.zip")
+	if err != nil {
+		return nil, meta, err
+	}
+	spool := &tempFile{File: tmp}
 
-	// Calculate total size for progress
-	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() {
-			size += info.Size()
+	zw := zip.NewWriter(tmp)
+	err = walkRoots(roots, func(filePath, name string, info os.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+		header.Name = name
 
-	go func() {
-		defer pw.Close()
-		zw := zip.NewWriter(pw)
-		defer zw.Close()
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+			meta.Files++
+			meta.RawSize += info.Size()
+		}
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
 
-		baseDir := filepath.Dir(path)
-		err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if !info.IsDir() {
+			f, err := os.Open(filePath)
 			if err != nil {
 				return err
 			}
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
+			defer f.Close()
+			if _, err := io.Copy(w, f); err != nil {
 				return err
 			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		meta.Size, err = tmp.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, meta, err
+	}
 
-			relPath, _ := filepath.Rel(baseDir, filePath)
-			header.Name = relPath
-
-			if info.IsDir() {
-				header.Name += "/"
-			} else {
-				header.Method = zip.Deflate
-			}
-
-			w, err := zw.CreateHeader(header)
-			if err != nil {
-				return err
-			}
+	return spool, meta, nil
+}
 
-			if !info.IsDir() {
-				f, err := os.Open(filePath)
-				if err != nil {
-					return err
-				}
-				defer f.Close()
-				if _, err := io.Copy(w, f); err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			// In a real app we might want to propagate this error to the reader?
-			// The PipeWriter.CloseWithError(err) could be used here.
-			pw.CloseWithError(err)
-		}
-	}()
+// tempFile removes the file when closed.
+type tempFile struct {
+	*os.File
+}
 
-	return pr, size, name, "dir", nil
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
 }
@@ -0,0 +1,832 @@
+package wormhole
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+// A session keeps the transit connection open after the key exchange, so
+// both peers can send files and text in either direction until one of them
+// closes it. Every record on the connection is a frame: a type byte, the
+// 4-byte big-endian ID of the transfer it belongs to, and the payload.
+// Transfers take turns frame by frame, and each may only have streamWindow
+// bytes in flight, so a slow one does not hold up the others.
+
+const (
+	frameControl byte = iota + 1 // a sessionMessage, with ID 0
+	frameData                    // data of a transfer
+	frameEnd                     // end of a transfer's data; the payload is its transferDigest
+	frameWindow                  // the reader took a 4-byte big-endian number of bytes
+)
+
+const (
+	// streamWindow is how much data of a transfer may be sent before the
+	// receiver has taken it.
+	streamWindow = 8 * 1024 * 1024
+	// maxFrameData bounds the data in one frame.
+	maxFrameData = 256 * 1024
+	// incomingBacklog is how many offers may wait for the application to
+	// take them from Incoming. Further offers are turned down.
+	incomingBacklog = 16
+	// sessionCloseTimeout bounds the wait for the peer to confirm the end
+	// of the session.
+	sessionCloseTimeout = 5 * time.Second
+)
+
+// ErrSessionClosed is returned for transfers cut short by the end of the
+// session.
+var ErrSessionClosed = errors.New("session closed")
+
+// Session is a transit connection kept open for any number of transfers in
+// both directions. Send and SendText may be called concurrently; offers from
+// the peer arrive on Incoming.
+type Session struct {
+	c    *Client
+	t    *transit.Transit
+	conn *transit.EncryptedConn
+
+	wmu sync.Mutex // serializes writes to conn
+
+	mu        sync.Mutex
+	transfers map[uint32]*sessionTransfer
+	nextID    uint32
+	closing   bool  // we sent the close message
+	err       error // why the connection failed
+
+	incoming chan *Incoming
+	done     chan struct{} // closed once the session has ended
+}
+
+// sessionTransfer is a transfer running over a session, in either
+// direction. Its fields are guarded by Session.mu.
+type sessionTransfer struct {
+	id   uint32
+	msgs chan sessionMessage // answers and acks from the peer
+	gone chan struct{}       // closed when err is set
+	err  error               // why the transfer cannot go on
+
+	// Sending: how many bytes the peer is ready for.
+	credit   int64
+	creditCh chan struct{}
+
+	// Receiving: data not taken yet, and what has been taken since the
+	// last window update.
+	accepted bool
+	discard  bool // abandoned by us; data still arriving is dropped
+	queue    [][]byte
+	queued   int64
+	taken    int64
+	ended    bool
+	digest   []byte
+	ready    chan struct{}
+}
+
+// Incoming is an offer the peer made during a session. Text messages are
+// accepted as they arrive; anything else waits for Accept or Reject.
+type Incoming struct {
+	Meta transit.Metadata
+	Text string // the message, if Meta.Mode is "text"
+
+	s  *Session
+	tr *sessionTransfer
+}
+
+// OpenSession offers the receiver a session instead of a single transfer.
+// It returns ErrDeclined if the receiver turns it down. The mailbox is closed
+// once the session is open.
+func (c *Client) OpenSession(ctx context.Context) (_ *Session, err error) {
+	defer func() { c.closeMailbox(moodFor(err)) }()
+
+	if !c.peerCan(abilitySession) {
+		c.sendMessage(ctx, appMessage{Error: "sender wanted a session, which the receiver does not support"})
+		return nil, errors.New("receiver does not support sessions")
+	}
+
+	t, err := c.startTransit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			t.Close()
+		}
+	}()
+
+	if err := c.sendMessage(ctx, appMessage{Offer: &offer{Session: &sessionOffer{}}}); err != nil {
+		return nil, err
+	}
+	peer, ans, err := c.awaitAnswer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ans.SessionAck != "ok" {
+		return nil, ErrDeclined
+	}
+	conn, err := c.PerformTransfer(ctx, t, peer)
+	if err != nil {
+		return nil, err
+	}
+	return c.newSession(t, conn), nil
+}
+
+// AcceptSession accepts a session offered by the sender, waiting for the
+// offer first unless ReceiveOffer was called. The mailbox is closed once the
+// session is open.
+func (c *Client) AcceptSession(ctx context.Context) (_ *Session, err error) {
+	defer func() { c.closeMailbox(moodFor(err)) }()
+
+	if err := c.receiveOffer(ctx); err != nil {
+		return nil, err
+	}
+	off := c.offer
+	c.offer = nil
+	if off.meta.Mode != "session" {
+		if off.t != nil {
+			off.t.Close()
+		}
+		c.sendMessage(ctx, appMessage{Error: "receiver expected a session"})
+		return nil, fmt.Errorf("sender offered a %s, not a session", off.meta.Mode)
+	}
+
+	if err := c.sendMessage(ctx, appMessage{Answer: &answer{SessionAck: "ok"}}); err != nil {
+		off.t.Close()
+		return nil, err
+	}
+	conn, err := c.PerformTransfer(ctx, off.t, *off.peer)
+	if err != nil {
+		off.t.Close()
+		return nil, err
+	}
+	return c.newSession(off.t, conn), nil
+}
+
+func (c *Client) newSession(t *transit.Transit, conn *transit.EncryptedConn) *Session {
+	s := &Session{
+		c:         c,
+		t:         t,
+		conn:      conn,
+		transfers: make(map[uint32]*sessionTransfer),
+		incoming:  make(chan *Incoming, incomingBacklog),
+		done:      make(chan struct{}),
+	}
+	// The sides pick their transfer IDs from different halves, odd for the
+	// sender and even for the receiver, so they never collide.
+	s.nextID = 2
+	if c.isSender {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	return s
+}
+
+// Incoming returns the offers made by the peer. The channel is closed when
+// the session ends.
+func (s *Session) Incoming() <-chan *Incoming {
+	return s.incoming
+}
+
+// Done is closed when the session has ended, after which Err tells why.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns nil if the session was closed by either side, and the
+// connection error if it broke.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the session. Transfers still running in either direction fail
+// with ErrSessionClosed.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	closing := s.closing
+	s.closing = true
+	s.mu.Unlock()
+	if !closing {
+		s.sendClose()
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(sessionCloseTimeout):
+		s.conn.Close()
+		<-s.done
+	}
+	return s.Err()
+}
+
+// sendClose tells the peer the session is over and ends our side of the
+// stream.
+func (s *Session) sendClose() {
+	s.writeControl(sessionMessage{Close: true})
+	s.wmu.Lock()
+	s.conn.CloseWrite()
+	s.wmu.Unlock()
+}
+
+// Send sends files and directories to the peer, as Client.SendFiles does,
+// while other transfers may be running.
+func (s *Session) Send(ctx context.Context, paths []string, progressCh chan<- Progress) (err error) {
+	reader, meta, err := s.c.openSource(paths)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// A session is not resumed, so there is no point in a journal.
+	meta.ContentID = ""
+
+	tr, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer s.finish(tr, &err)
+	if err := s.writeControl(sessionMessage{ID: tr.id, Offer: offerFromMetadata(meta)}); err != nil {
+		return err
+	}
+	m, err := s.wait(ctx, tr)
+	if err != nil {
+		return err
+	}
+	if m.Answer == nil || m.Answer.FileAck != "ok" {
+		return ErrDeclined
+	}
+
+	if err := s.sendData(ctx, tr, reader, meta, progressCh); err != nil {
+		return err
+	}
+	m, err = s.wait(ctx, tr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case m.Ack == nil:
+		return errors.New("invalid confirmation from peer")
+	case m.Ack.Ack == ackHashMismatch:
+		return ErrHashMismatch
+	case m.Ack.Ack != ackOK:
+		return fmt.Errorf("transfer failed (peer says %q)", m.Ack.Ack)
+	}
+	return nil
+}
+
+// sendData sends what reader holds as the transfer's data, followed by the
+// end frame carrying its digest.
+func (s *Session) sendData(ctx context.Context, tr *sessionTransfer, reader io.Reader, meta transit.Metadata, progressCh chan<- Progress) error {
+	progress := wireProgress(meta.Size)
+	if ts, ok := reader.(*tarStream); ok {
+		progress = ts.progress
+	}
+	if meta.Size >= 0 {
+		reader = io.LimitReader(reader, meta.Size)
+	}
+
+	hasher := sha256.New()
+	start := time.Now()
+	buf := make([]byte, maxFrameData)
+	var sent int64
+	for {
+		n, rErr := reader.Read(buf)
+		if n > 0 {
+			hasher.Write(buf[:n])
+			if err := s.writeData(ctx, tr, buf[:n]); err != nil {
+				return err
+			}
+			sent += int64(n)
+			if progressCh != nil {
+				p := progress(sent)
+				p.Rate = rate(sent, start)
+				progressCh <- p
+			}
+		}
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			return &sourceError{name: meta.Name, err: rErr}
+		}
+	}
+	if meta.Size >= 0 && sent < meta.Size {
+		return &sourceError{name: meta.Name, err: errors.New("file shrank while sending")}
+	}
+
+	digest, _ := json.Marshal(transferDigest{SHA256: hex.EncodeToString(hasher.Sum(nil))})
+	return s.writeFrame(frameEnd, tr.id, digest)
+}
+
+// SendText sends a text message to the peer.
+func (s *Session) SendText(ctx context.Context, text string) (err error) {
+	tr, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer s.finish(tr, &err)
+	if err := s.writeControl(sessionMessage{ID: tr.id, Offer: &offer{Message: &text}}); err != nil {
+		return err
+	}
+	m, err := s.wait(ctx, tr)
+	if err != nil {
+		return err
+	}
+	if m.Answer == nil || m.Answer.MessageAck != "ok" {
+		return ErrDeclined
+	}
+	return nil
+}
+
+// Accept receives the offered file or directory into outDir and returns the
+// name it was saved under. Other transfers go on meanwhile.
+func (in *Incoming) Accept(ctx context.Context, outDir string, progressCh chan<- Progress) (_ string, err error) {
+	s, tr := in.s, in.tr
+	if tr == nil {
+		return "", errors.New("nothing to accept")
+	}
+	defer s.finish(tr, &err)
+
+	sk, err := openSink(outDir, in.Meta)
+	if err != nil {
+		s.abandon(tr, sessionMessage{Error: "receiver cannot write the " + sk.kind()})
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			sk.abort(err)
+		}
+	}()
+	if err := sk.checkSpace(); err != nil {
+		s.abandon(tr, sessionMessage{Error: rejectMessage, Reason: ErrNoSpace.Error()})
+		return "", err
+	}
+
+	s.mu.Lock()
+	tr.accepted = true
+	s.mu.Unlock()
+	if err := s.writeControl(sessionMessage{ID: tr.id, Answer: &answer{FileAck: "ok"}}); err != nil {
+		return "", err
+	}
+
+	digest, err := s.receiveData(ctx, tr, sk, progressCh)
+	if err != nil {
+		return "", err
+	}
+	if err := sk.close(); err != nil {
+		return "", err
+	}
+	if progressCh != nil && sk.tree != nil {
+		progressCh <- sk.tree.progress()
+	}
+
+	result := transferAck{Ack: ackOK, SHA256: hex.EncodeToString(sk.hasher.Sum(nil))}
+	if digest.SHA256 != result.SHA256 {
+		result.Ack = ackHashMismatch
+	}
+	var saved string
+	if result.Ack == ackOK {
+		if saved, err = sk.finish(); err != nil {
+			return "", err
+		}
+	}
+	if err := s.writeControl(sessionMessage{ID: tr.id, Ack: &result}); err != nil {
+		return "", err
+	}
+	if result.Ack == ackHashMismatch {
+		return "", ErrHashMismatch
+	}
+	return saved, nil
+}
+
+// receiveData writes the transfer's data to sk until its end frame, and
+// returns the digest that came with it.
+func (s *Session) receiveData(ctx context.Context, tr *sessionTransfer, sk *sink, progressCh chan<- Progress) (transferDigest, error) {
+	var digest transferDigest
+	start := time.Now()
+	var received int64
+	for {
+		data, err := s.read(ctx, tr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return digest, err
+		}
+		received += int64(len(data))
+		if sk.meta.Size >= 0 && received > sk.meta.Size {
+			return digest, fmt.Errorf("peer sent more data than offered")
+		}
+		if _, err := sk.w.Write(data); err != nil {
+			return digest, err
+		}
+		if progressCh != nil {
+			p := sk.progress(received)
+			p.Rate = rate(received, start)
+			progressCh <- p
+		}
+	}
+	if sk.meta.Size >= 0 && received < sk.meta.Size {
+		return digest, fmt.Errorf("peer ended the transfer after %d of %d bytes", received, sk.meta.Size)
+	}
+	if err := sk.w.Flush(); err != nil {
+		return digest, err
+	}
+
+	s.mu.Lock()
+	raw := tr.digest
+	s.mu.Unlock()
+	if json.Unmarshal(raw, &digest) != nil || digest.SHA256 == "" {
+		return digest, fmt.Errorf("invalid digest from peer")
+	}
+	return digest, nil
+}
+
+// Reject declines the offer.
+func (in *Incoming) Reject() error {
+	if in.tr == nil {
+		return nil
+	}
+	defer in.s.forget(in.tr)
+	return in.s.writeControl(sessionMessage{ID: in.tr.id, Error: rejectMessage})
+}
+
+// open starts a transfer of ours.
+func (s *Session) open() (*sessionTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing || isClosed(s.done) {
+		return nil, ErrSessionClosed
+	}
+	tr := newSessionTransfer(s.nextID)
+	tr.credit = streamWindow
+	s.nextID += 2
+	s.transfers[tr.id] = tr
+	return tr, nil
+}
+
+func newSessionTransfer(id uint32) *sessionTransfer {
+	return &sessionTransfer{
+		id:       id,
+		msgs:     make(chan sessionMessage, 4),
+		gone:     make(chan struct{}),
+		creditCh: make(chan struct{}, 1),
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// forget drops a finished transfer.
+func (s *Session) forget(tr *sessionTransfer) {
+	s.mu.Lock()
+	delete(s.transfers, tr.id)
+	s.mu.Unlock()
+}
+
+// finish drops a transfer once it is over, first telling the peer if we
+// gave up on it because of *err.
+func (s *Session) finish(tr *sessionTransfer, err *error) {
+	s.mu.Lock()
+	told := tr.err != nil || tr.discard // the peer ended it, or knows already
+	s.mu.Unlock()
+	if *err != nil && !told && !errors.Is(*err, ErrHashMismatch) {
+		reason := "transfer aborted: " + abortReason(*err)
+		if errors.Is(*err, context.Canceled) {
+			reason = "transfer cancelled"
+		}
+		s.abandon(tr, sessionMessage{Error: reason})
+	}
+	s.forget(tr)
+}
+
+// abandon tells the peer we give up on the transfer, with m's error. Its
+// data may still be on the way, and is dropped.
+func (s *Session) abandon(tr *sessionTransfer, m sessionMessage) {
+	s.mu.Lock()
+	tr.discard = true
+	tr.queue, tr.queued = nil, 0
+	s.mu.Unlock()
+	m.ID = tr.id
+	s.writeControl(m)
+}
+
+// fail ends the transfer with err. s.mu must be held.
+func (tr *sessionTransfer) fail(err error) {
+	if tr.err == nil {
+		tr.err = err
+		close(tr.gone)
+	}
+}
+
+// wait returns the peer's next message about the transfer.
+func (s *Session) wait(ctx context.Context, tr *sessionTransfer) (sessionMessage, error) {
+	select {
+	case m := <-tr.msgs:
+		return m, nil
+	case <-tr.gone:
+		// A message that came in before the transfer ended still counts.
+		select {
+		case m := <-tr.msgs:
+			return m, nil
+		default:
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return sessionMessage{}, tr.err
+	case <-ctx.Done():
+		return sessionMessage{}, ctx.Err()
+	}
+}
+
+// writeData sends p as data of the transfer, waiting for the peer to make
+// room for it.
+func (s *Session) writeData(ctx context.Context, tr *sessionTransfer, p []byte) error {
+	for len(p) > 0 {
+		s.mu.Lock()
+		err := tr.err
+		n := min(int64(len(p)), tr.credit)
+		tr.credit -= n
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			select {
+			case <-tr.creditCh:
+			case <-tr.gone:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if err := s.writeFrame(frameData, tr.id, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// read returns the next data of the transfer, or io.EOF after its end
+// frame. Taking data makes room for more, which the peer is told about.
+func (s *Session) read(ctx context.Context, tr *sessionTransfer) ([]byte, error) {
+	for {
+		s.mu.Lock()
+		switch {
+		case tr.err != nil:
+			s.mu.Unlock()
+			return nil, tr.err
+		case len(tr.queue) > 0:
+			data := tr.queue[0]
+			tr.queue = tr.queue[1:]
+			tr.queued -= int64(len(data))
+			tr.taken += int64(len(data))
+			var grant int64
+			if tr.taken >= streamWindow/2 {
+				grant, tr.taken = tr.taken, 0
+			}
+			s.mu.Unlock()
+			if grant > 0 {
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], uint32(grant))
+				if err := s.writeFrame(frameWindow, tr.id, b[:]); err != nil {
+					return nil, err
+				}
+			}
+			return data, nil
+		case tr.ended:
+			s.mu.Unlock()
+			return nil, io.EOF
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-tr.ready:
+		case <-tr.gone:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Session) writeControl(m sessionMessage) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.writeFrame(frameControl, 0, payload)
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	record := make([]byte, 5+len(payload))
+	record[0] = typ
+	binary.BigEndian.PutUint32(record[1:5], id)
+	copy(record[5:], payload)
+
+	s.wmu.Lock()
+	err := s.conn.WriteRecord(record)
+	s.wmu.Unlock()
+	if err != nil {
+		// Writes fail once the session is over; say so rather than how.
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.err != nil {
+			return s.err
+		}
+		if s.closing {
+			return ErrSessionClosed
+		}
+	}
+	return err
+}
+
+// readLoop dispatches the frames from the peer until the session ends. It
+// never writes to the connection itself, which could block while the peer
+// is blocked writing to us; replies are sent from their own goroutines.
+func (s *Session) readLoop() {
+	var err error
+	for {
+		var record []byte
+		record, err = s.conn.ReadRecord()
+		if err != nil {
+			break
+		}
+		if len(record) < 5 {
+			err = errors.New("invalid frame from peer")
+			break
+		}
+		if err = s.dispatch(record[0], binary.BigEndian.Uint32(record[1:5]), record[5:]); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		// The peer ended its side after the close message.
+		err = nil
+	}
+
+	s.mu.Lock()
+	if err != nil && !s.closing {
+		s.err = fmt.Errorf("session connection lost: %w", err)
+	}
+	for _, tr := range s.transfers {
+		if s.err != nil {
+			tr.fail(s.err)
+		} else {
+			tr.fail(ErrSessionClosed)
+		}
+	}
+	s.closing = true
+	s.mu.Unlock()
+
+	close(s.incoming)
+	s.conn.Close()
+	s.t.Close()
+	close(s.done)
+}
+
+// dispatch handles one frame. An error ends the session.
+func (s *Session) dispatch(typ byte, id uint32, payload []byte) error {
+	if typ == frameControl {
+		var m sessionMessage
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return fmt.Errorf("invalid control message from peer: %w", err)
+		}
+		return s.control(m)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tr := s.transfers[id]
+	if tr == nil {
+		// Data of a transfer that is already over.
+		return nil
+	}
+	switch typ {
+	case frameData:
+		if tr.discard {
+			return nil
+		}
+		if !tr.accepted || tr.ended || tr.queued+int64(len(payload)) > streamWindow {
+			return fmt.Errorf("peer sent data for transfer %d out of turn", id)
+		}
+		tr.queue = append(tr.queue, payload)
+		tr.queued += int64(len(payload))
+		signal(tr.ready)
+	case frameEnd:
+		tr.ended, tr.digest = true, payload
+		signal(tr.ready)
+	case frameWindow:
+		if len(payload) != 4 {
+			return errors.New("invalid window update from peer")
+		}
+		tr.credit += int64(binary.BigEndian.Uint32(payload))
+		signal(tr.creditCh)
+	default:
+		return fmt.Errorf("unknown frame type %d from peer", typ)
+	}
+	return nil
+}
+
+// control handles a control message from the peer.
+func (s *Session) control(m sessionMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case m.Close:
+		for _, tr := range s.transfers {
+			tr.fail(ErrSessionClosed)
+		}
+		if !s.closing {
+			s.closing = true
+			go s.sendClose()
+		}
+
+	case m.Offer != nil:
+		if m.ID == 0 || m.ID%2 == s.nextID%2 || s.transfers[m.ID] != nil {
+			return fmt.Errorf("peer offered a transfer with invalid ID %d", m.ID)
+		}
+		s.offered(m.ID, m.Offer)
+
+	default:
+		tr := s.transfers[m.ID]
+		if tr == nil {
+			return nil
+		}
+		switch {
+		case m.Error == rejectMessage:
+			tr.fail(declined(m.Reason))
+		case m.Error != "":
+			tr.fail(s.c.peerError(m.Error))
+		default:
+			select {
+			case tr.msgs <- m:
+			default:
+				return fmt.Errorf("peer sent too many messages for transfer %d", m.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// offered passes an offer from the peer on to Incoming. s.mu must be held.
+func (s *Session) offered(id uint32, off *offer) {
+	reply := func(m sessionMessage) {
+		m.ID = id
+		go s.writeControl(m)
+	}
+	if s.closing {
+		reply(sessionMessage{Error: "session is closing"})
+		return
+	}
+
+	in := &Incoming{s: s}
+	if off.Message != nil {
+		in.Meta = transit.Metadata{Mode: "text", Size: int64(len(*off.Message))}
+		in.Text = *off.Message
+	} else {
+		meta, ok := metadataFromOffer(off)
+		if !ok || meta.Mode == "session" {
+			reply(sessionMessage{Error: "unsupported offer"})
+			return
+		}
+		in.Meta = meta
+		in.tr = newSessionTransfer(id)
+		s.transfers[id] = in.tr
+	}
+
+	select {
+	case s.incoming <- in:
+	default:
+		delete(s.transfers, id)
+		reply(sessionMessage{Error: "receiver is busy"})
+		return
+	}
+	if in.tr == nil {
+		reply(sessionMessage{Answer: &answer{MessageAck: "ok"}})
+	}
+}
+
+// signal wakes up whoever waits on ch, if anyone.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || dragonfly || windows)
+
+package wormhole
+
+import "errors"
+
+// freeSpace is not implemented here; the check is skipped.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,144 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+
+	"github.com/frostbyte57/GoPipe/internal/mailbox"
+)
+
+// The client follows the mailbox protocol as a state machine. One goroutine,
+// run, takes every event from the mailbox server and applies it under c.mu;
+// the methods that make requests then await the state they expect. Messages
+// from the peer are kept in an inbox by phase until they are asked for, so
+// they may arrive in any order and none is lost.
+
+// mailboxState is how far the client got with the mailbox server.
+type mailboxState int
+
+const (
+	stateIdle       mailboxState = iota // not connected
+	stateConnected                      // connected, no nameplate yet
+	stateAllocating                     // waiting for the server to allocate a nameplate
+	stateAllocated                      // c.nameplate was allocated, not claimed yet
+	stateClaiming                       // waiting for the server to claim c.nameplate
+	stateOpen                           // c.mailboxID is open; the peer's messages go to c.inbox
+	stateClosing                        // waiting for the server to close the mailbox
+	stateClosed                         // the mailbox is closed
+)
+
+// errMailboxClosed is returned while waiting for the peer once the mailbox
+// has been closed.
+var errMailboxClosed = errors.New("mailbox closed")
+
+// errOutOfOrder is returned when a request does not fit the state, e.g. a
+// second PrepareSend on the same client.
+var errOutOfOrder = errors.New("mailbox client used out of order")
+
+// run applies the events from the mailbox server until the connection is
+// gone, waking up everyone who waits after each.
+func (c *Client) run() {
+	for {
+		ev, err := c.mail.Next(context.Background())
+		c.mu.Lock()
+		var serverErr *mailbox.ServerError
+		switch {
+		case errors.As(err, &serverErr):
+			// Errors are returned by the request they reject; one that
+			// reaches us here belongs to no request, and no one waits for it.
+		case err != nil:
+			if c.mailErr == nil {
+				c.mailErr = err
+			}
+		default:
+			c.handle(ev)
+		}
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.mu.Unlock()
+		if err != nil && serverErr == nil {
+			return
+		}
+	}
+}
+
+// handle moves the state machine on by an event from the server. Answers
+// the client is not waiting for are ignored. c.mu must be held.
+func (c *Client) handle(ev interface{}) {
+	switch msg := ev.(type) {
+	case mailbox.AllocatedMessage:
+		if c.state == stateAllocating {
+			c.nameplate = msg.Nameplate
+			c.state = stateAllocated
+		}
+	case mailbox.ClaimedMessage:
+		if c.state == stateClaiming {
+			c.mailboxID = msg.Mailbox
+			c.state = stateOpen
+		}
+	case mailbox.MessageMessage:
+		if msg.Side == c.side {
+			return
+		}
+		if _, ok := c.inbox[msg.Phase]; !ok {
+			c.inbox[msg.Phase] = msg
+		}
+	case mailbox.ClosedMessage:
+		c.state = stateClosed
+	case mailbox.NameplatesMessage:
+		c.nameplates = make([]string, len(msg.Nameplates))
+		for i, n := range msg.Nameplates {
+			c.nameplates[i] = n.ID
+		}
+	}
+}
+
+// transition moves the state machine from one state to another before a
+// request is made. It fails if the client is not in state from.
+func (c *Client) transition(from, to mailboxState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != from {
+		return errOutOfOrder
+	}
+	c.state = to
+	return nil
+}
+
+// await waits until ready, called with c.mu held, reports true. It gives up
+// once the connection to the server fails.
+func (c *Client) await(ctx context.Context, ready func() bool) error {
+	for {
+		c.mu.Lock()
+		ok, err, changed := ready(), c.mailErr, c.changed
+		c.mu.Unlock()
+		if ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitPhase waits for the peer's message in the given phase, and takes it
+// from the inbox.
+func (c *Client) waitPhase(ctx context.Context, phase string) (mailbox.MessageMessage, error) {
+	var m mailbox.MessageMessage
+	err := c.await(ctx, func() bool {
+		var ok bool
+		if m, ok = c.inbox[phase]; ok {
+			delete(c.inbox, phase)
+		}
+		return ok || c.state == stateClosing || c.state == stateClosed
+	})
+	if err == nil && m.Phase == "" {
+		err = errMailboxClosed
+	}
+	return m, err
+}
@@ -0,0 +1,162 @@
+"""Generates the transcripts the compatibility tests check GoPipe against.
+
+    python3 transcripts.py wormhole > transcript.json
+    python3 transcripts.py transit > ../../transit/testdata/transit.json
+
+Nothing here is taken from GoPipe, nor from magic-wormhole's code: the key
+derivations follow magic-wormhole's derive_key and derive_phase_key, the
+transit framing its transit protocol, and XSalsa20-Poly1305 is written out
+below so that only the Python standard library is needed. These are not
+recordings of real sessions.
+
+The pake_v1 values are placeholders. The SPAKE2 exchange is left to the
+SPAKE2 library, so only the framing of its messages is checked here.
+"""
+
+import hashlib, hmac, json, struct, binascii, sys
+
+def hkdf(key, info, length=32, salt=None):
+    if not salt:
+        salt = b"\x00" * 32
+    prk = hmac.new(salt, key, hashlib.sha256).digest()
+    out, t, i = b"", b"", 1
+    while len(out) < length:
+        t = hmac.new(prk, t + info + bytes([i]), hashlib.sha256).digest()
+        out += t
+        i += 1
+    return out[:length]
+
+def derive_key(key, purpose):
+    return hkdf(key, purpose)
+
+def derive_phase_key(key, side, phase):
+    purpose = b"wormhole:phase:" + hashlib.sha256(side.encode()).digest() + hashlib.sha256(phase.encode()).digest()
+    return derive_key(key, purpose)
+
+M = 0xffffffff
+def rotl(v, c): return ((v << c) & M) | (v >> (32 - c))
+
+def qr(x, a, b, c, d):
+    x[b] ^= rotl((x[a] + x[d]) & M, 7)
+    x[c] ^= rotl((x[b] + x[a]) & M, 9)
+    x[d] ^= rotl((x[c] + x[b]) & M, 13)
+    x[a] ^= rotl((x[d] + x[c]) & M, 18)
+
+def rounds(x):
+    for _ in range(10):
+        qr(x, 0, 4, 8, 12); qr(x, 5, 9, 13, 1); qr(x, 10, 14, 2, 6); qr(x, 15, 3, 7, 11)
+        qr(x, 0, 1, 2, 3); qr(x, 5, 6, 7, 4); qr(x, 10, 11, 8, 9); qr(x, 15, 12, 13, 14)
+
+SIGMA = struct.unpack("<4I", b"expand 32-byte k")
+
+def setup(key, n16):
+    k = struct.unpack("<8I", key)
+    n = struct.unpack("<4I", n16)
+    return [SIGMA[0], k[0], k[1], k[2], k[3], SIGMA[1], n[0], n[1], n[2], n[3], SIGMA[2], k[4], k[5], k[6], k[7], SIGMA[3]]
+
+def hsalsa20(key, n16):
+    x = setup(key, n16)
+    rounds(x)
+    return struct.pack("<8I", x[0], x[5], x[10], x[15], x[6], x[7], x[8], x[9])
+
+def salsa20_stream(key, n8, length):
+    out = b""
+    ctr = 0
+    while len(out) < length:
+        inp = setup(key, n8 + struct.pack("<Q", ctr))
+        x = list(inp)
+        rounds(x)
+        out += struct.pack("<16I", *[(x[i] + inp[i]) & M for i in range(16)])
+        ctr += 1
+    return out[:length]
+
+def poly1305(key, msg):
+    r = int.from_bytes(key[:16], "little") & 0x0ffffffc0ffffffc0ffffffc0fffffff
+    s = int.from_bytes(key[16:], "little")
+    p = (1 << 130) - 5
+    acc = 0
+    for i in range(0, len(msg), 16):
+        block = msg[i:i+16] + b"\x01"
+        acc = ((acc + int.from_bytes(block, "little")) * r) % p
+    return ((acc + s) % (1 << 128)).to_bytes(16, "little")
+
+def secretbox(key, nonce, msg):
+    subkey = hsalsa20(key, nonce[:16])
+    stream = salsa20_stream(subkey, nonce[16:], 32 + len(msg))
+    c = bytes(a ^ b for a, b in zip(msg, stream[32:]))
+    return poly1305(stream[:32], c) + c
+
+def h(b): return binascii.hexlify(b).decode()
+
+APPID = "lothar.com/wormhole/text-or-file-xfer"
+
+def wormhole():
+    key = hashlib.sha256(b"gopipe transcript session key").digest()
+    sides = {"A": "1f3e6a09c2", "B": "b70d41e8aa"}
+    nonce_ctr = [0]
+    def box(side, phase, plaintext):
+        nonce_ctr[0] += 1
+        nonce = hashlib.sha256(b"nonce %d" % nonce_ctr[0]).digest()[:24]
+        k = derive_phase_key(key, side, phase)
+        return nonce, nonce + secretbox(k, nonce, plaintext.encode())
+    msgs = []
+    def pake(who, spake):
+        body = json.dumps({"pake_v1": h(spake)})
+        msgs.append({"side": sides[who], "phase": "pake", "body": h(body.encode()), "pake_v1": h(spake)})
+    def enc(who, phase, plaintext):
+        nonce, ct = box(sides[who], phase, plaintext)
+        msgs.append({"side": sides[who], "phase": phase, "body": h(ct), "plaintext": plaintext})
+    pake("A", b"A" + hashlib.sha256(b"pake A").digest())
+    pake("B", b"B" + hashlib.sha256(b"pake B").digest())
+    enc("A", "version", json.dumps({"app_versions": {"gopipe": {"abilities": ["eos-v1", "sha256-v1"], "role": "sender"}}}, separators=(",", ":")))
+    enc("B", "version", json.dumps({"app_versions": {}}))
+    enc("A", "0", json.dumps({"transit": {"abilities-v1": [{"type": "direct-tcp-v1"}, {"type": "relay-v1"}], "hints-v1": [{"type": "direct-tcp-v1", "priority": 1, "hostname": "192.0.2.2", "port": 40321}, {"type": "relay-v1", "priority": 0, "hints": [{"type": "direct-tcp-v1", "priority": 0, "hostname": "transit.magic-wormhole.io", "port": 4001}]}]}}, separators=(",", ":")))
+    enc("A", "1", json.dumps({"offer": {"file": {"filename": "hello.txt", "filesize": 12}}}, separators=(",", ":")))
+    enc("B", "0", json.dumps({"transit": {"abilities-v1": [{"type": "direct-tcp-v1"}, {"type": "relay-v1"}], "hints-v1": [{"type": "direct-tcp-v1", "priority": 0.0, "hostname": "198.51.100.7", "port": 4002}, {"type": "relay-v1", "hints": [{"type": "direct-tcp-v1", "priority": 0.0, "hostname": "transit.magic-wormhole.io", "port": 4001}]}]}}))
+    enc("B", "1", json.dumps({"answer": {"file_ack": "ok"}}, separators=(",", ":")))
+    enc("A", "2", json.dumps({"offer": {"message": "hello, wormhole"}}, separators=(",", ":")))
+    enc("B", "2", json.dumps({"answer": {"message_ack": "ok"}}, separators=(",", ":")))
+    enc("A", "3", json.dumps({"offer": {"directory": {"mode": "zipfile/deflated", "dirname": "photos", "zipsize": 1024, "numbytes": 4096, "numfiles": 3}}}, separators=(",", ":")))
+    enc("B", "3", json.dumps({"error": "transfer rejected"}, separators=(",", ":")))
+    return {
+        "appid": APPID,
+        "key": h(key),
+        "verifier": h(derive_key(key, b"wormhole:verifier")),
+        "transit_key": h(derive_key(key, (APPID + "/transit-key").encode())),
+        "messages": msgs,
+    }
+
+def transit():
+    key = hashlib.sha256(b"gopipe transcript transit key").digest()
+    side = "5a1e0b9c3d7f2e41"
+    sk = derive_key(key, b"transit_record_sender_key")
+    rk = derive_key(key, b"transit_record_receiver_key")
+    def frames(k, plaintexts, first=0):
+        out = []
+        for seq, p in enumerate(plaintexts, first):
+            nonce = b"\x00" * 16 + struct.pack(">Q", seq)
+            box = nonce + secretbox(k, nonce, p)
+            out.append({"plaintext": h(p), "frame": h(struct.pack(">I", len(box)) + box)})
+        return out
+    data = b"hello, world\n"
+    digest = hashlib.sha256(data).hexdigest()
+    # A magic-wormhole transfer: the file in records, and the receiver's ack.
+    sender = [b"hello, ", b"world\n"]
+    receiver = [json.dumps({"ack": "ok", "sha256": digest}).encode()]
+    return {
+        "key": h(key),
+        "side": side,
+        "sender_handshake": "transit sender %s ready\n\n" % h(derive_key(key, b"transit_sender")),
+        "receiver_handshake": "transit receiver %s ready\n\n" % h(derive_key(key, b"transit_receiver")),
+        "relay_request": "please relay %s for side %s\n" % (h(derive_key(key, b"transit_relay_token")), side),
+        "sender_records": frames(sk, sender),
+        "receiver_records": frames(rk, receiver),
+        # What GoPipe peers send after those: the sender's digest record
+        # (sha256-v1) and an empty record for the end of the stream (eos-v1).
+        "gopipe_sender_records": frames(sk, [json.dumps({"sha256": digest}).encode(), b""], len(sender)),
+        "gopipe_receiver_records": frames(rk, [b""], len(receiver)),
+    }
+
+if __name__ == "__main__":
+    out = {"wormhole": wormhole, "transit": transit}[sys.argv[1]]()
+    print(json.dumps(out, indent="\t"))
@@ -0,0 +1,290 @@
+package wormhole
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frostbyte57/GoPipe/internal/mailbox"
+	"github.com/frostbyte57/GoPipe/internal/transit"
+)
+
+// testServers runs a mailbox server and a transit relay in this process,
+// and returns their addresses. The relay lets the peers meet even where
+// there is no address to connect to directly.
+func testServers(t *testing.T) (mailboxURL, relay string) {
+	t.Helper()
+	srv := mailbox.NewServer()
+	hs := httptest.NewServer(srv)
+	t.Cleanup(func() { hs.Close(); srv.Close() })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := transit.NewRelayServer()
+	go rs.Serve(l)
+	t.Cleanup(func() { rs.Close() })
+
+	return "ws" + strings.TrimPrefix(hs.URL, "http") + "/v1", l.Addr().String()
+}
+
+// connectPeers returns a sender and a receiver that completed the key
+// exchange through the servers.
+func connectPeers(ctx context.Context, t *testing.T, mailboxURL, relay string) (sender, receiver *Client) {
+	t.Helper()
+	sender = NewClient("", mailboxURL, relay)
+	code, err := sender.PrepareSend(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sender.PerformHandshake(ctx)
+		errc <- err
+	}()
+
+	receiver = NewClient("", mailboxURL, relay)
+	if err := receiver.PrepareReceive(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.PerformHandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sender.Verifier(), receiver.Verifier()) {
+		t.Fatal("the peers show different verifiers")
+	}
+	return sender, receiver
+}
+
+func TestSendText(t *testing.T) {
+	mailboxURL, relay := testServers(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sender, receiver := connectPeers(ctx, t, mailboxURL, relay)
+
+	errc := make(chan error, 1)
+	go func() { errc <- sender.SendText(ctx, "héllo\nworld") }()
+	text, err := receiver.ReceiveText(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "héllo\nworld" {
+		t.Errorf("received %q", text)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	mailboxURL, relay := testServers(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sender, receiver := connectPeers(ctx, t, mailboxURL, relay)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "data.bin")
+	data := bytes.Repeat([]byte("gopipe "), 300000)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- sender.SendFile(ctx, src, nil) }()
+	meta, err := receiver.ReceiveOffer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Mode != "file" || meta.Name != "data.bin" || meta.Size != int64(len(data)) {
+		t.Fatalf("offer %+v", meta)
+	}
+	name, err := receiver.ReceiveFile(ctx, out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes that differ from the %d sent", len(got), len(data))
+	}
+}
+
+func TestResume(t *testing.T) {
+	mailboxURL, relay := testServers(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sender, receiver := connectPeers(ctx, t, mailboxURL, relay)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "data.bin")
+	data := bytes.Repeat([]byte("0123456789"), 300000)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An earlier attempt left the first megabyte behind, followed by bytes
+	// that were never checkpointed.
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prefix := data[:1000000]
+	part := filepath.Join(out, "data.bin"+partSuffix)
+	journalPath := filepath.Join(out, "data.bin"+journalSuffix)
+	if err := os.WriteFile(part, append(bytes.Clone(prefix), "junk"...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(prefix)
+	j, _ := json.Marshal(journal{
+		ContentID: contentID(info),
+		Name:      "data.bin",
+		Size:      int64(len(data)),
+		Offset:    int64(len(prefix)),
+		SHA256:    hex.EncodeToString(sum[:]),
+	})
+	if err := os.WriteFile(journalPath, j, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- sender.SendFile(ctx, src, nil) }()
+	progressCh := make(chan Progress, 16)
+	first := make(chan int64, 1)
+	go func() {
+		p := <-progressCh
+		first <- p.Current
+		for range progressCh {
+		}
+	}()
+	name, err := receiver.ReceiveFile(ctx, out, progressCh)
+	close(progressCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n := <-first; n <= int64(len(prefix)) {
+		t.Errorf("first progress at %d bytes, the transfer did not resume", n)
+	}
+	got, err := os.ReadFile(filepath.Join(out, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("resumed file differs from the one sent")
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Errorf("journal left behind: %v", err)
+	}
+}
+
+func TestRejectOffer(t *testing.T) {
+	mailboxURL, relay := testServers(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sender, receiver := connectPeers(ctx, t, mailboxURL, relay)
+
+	src := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(src, []byte("unwanted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- sender.SendFile(ctx, src, nil) }()
+	if _, err := receiver.ReceiveOffer(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.RejectOffer(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, ErrDeclined) {
+		t.Fatalf("sender got %v, want ErrDeclined", err)
+	}
+}
+
+func TestNoSpace(t *testing.T) {
+	mailboxURL, relay := testServers(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sender, receiver := connectPeers(ctx, t, mailboxURL, relay)
+
+	// A sparse file larger than the free space of the disk it is on.
+	dir := t.TempDir()
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skip("free space unknown:", err)
+	}
+	src := filepath.Join(dir, "huge.bin")
+	if err := os.WriteFile(src, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(src, free+1<<30); err != nil {
+		t.Skip("cannot create a sparse file:", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- sender.SendFile(ctx, src, nil) }()
+	if _, err := receiver.ReceiveFile(ctx, dir, nil); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("receiver got %v, want ErrNoSpace", err)
+	}
+	err = <-errc
+	if !errors.Is(err, ErrDeclined) || !strings.Contains(err.Error(), ErrNoSpace.Error()) {
+		t.Errorf("sender got %v, want ErrDeclined for lack of space", err)
+	}
+}
+
+func TestWrongCode(t *testing.T) {
+	mailboxURL, relay := testServers(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sender := NewClient("", mailboxURL, relay)
+	code, err := sender.PrepareSend(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sender.PerformHandshake(ctx)
+		errc <- err
+	}()
+
+	nameplate, _, _ := strings.Cut(code, "-")
+	receiver := NewClient("", mailboxURL, relay)
+	if err := receiver.PrepareReceive(ctx, nameplate+"-wrong-words"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.PerformHandshake(ctx); !errors.Is(err, ErrWrongCode) {
+		t.Errorf("receiver got %v, want ErrWrongCode", err)
+	}
+	if err := <-errc; !errors.Is(err, ErrWrongCode) {
+		t.Errorf("sender got %v, want ErrWrongCode", err)
+	}
+}
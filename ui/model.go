@@ -12,6 +12,7 @@ type State int
 const (
 	StateMenu State = iota
 	StateSend
+	StateSendText
 	StateReceive
 	StateSettings
 )
@@ -21,17 +22,21 @@ type Model struct {
 	choices       []string
 	cursor        int
 	sendModel     SendModel
+	sendTextModel SendTextModel
 	receiveModel  ReceiveModel
 	settingsModel SettingsModel
 	confirmExit   bool
 }
 
-func InitialModel(mailboxURL string) Model {
+// InitialModel returns the menu. With verify, transfers wait until the user
+// confirms that both sides show the same verifier.
+func InitialModel(mailboxURL string, relay string, verify bool) Model {
 	return Model{
 		state:         StateMenu,
-		choices:       []string{"Send File", "Receive File", "Settings"},
-		sendModel:     NewSendModel(mailboxURL),
-		receiveModel:  NewReceiveModel(mailboxURL),
+		choices:       []string{"Send File", "Send Text", "Receive", "Settings"},
+		sendModel:     NewSendModel(mailboxURL, relay, verify),
+		sendTextModel: NewSendTextModel(mailboxURL, relay, verify),
+		receiveModel:  NewReceiveModel(mailboxURL, relay, verify),
 		settingsModel: NewSettingsModel(),
 	}
 }
@@ -53,6 +58,10 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// Reset valid flag on any other key
 		m.confirmExit = false
 	}
+	if _, ok := msg.(BackToMenuMsg); ok {
+		m.state = StateMenu
+		return m, nil
+	}
 
 	// State-specific Handling
 	switch m.state {
@@ -64,6 +73,11 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.sendModel = newM.(SendModel)
 		return m, cmd
 
+	case StateSendText:
+		newM, cmd := m.sendTextModel.Update(msg)
+		m.sendTextModel = newM.(SendTextModel)
+		return m, cmd
+
 	case StateReceive:
 		newM, cmd := m.receiveModel.Update(msg)
 		m.receiveModel = newM.(ReceiveModel)
@@ -97,11 +111,15 @@ func (m Model) updateMenu(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "enter", " ":
 			if m.cursor == 0 {
 				m.state = StateSend
-				m.sendModel = NewSendModel(m.sendModel.mailboxURL)
+				m.sendModel = NewSendModel(m.sendModel.mailboxURL, m.sendModel.relay, m.sendModel.verify)
 				return m, m.sendModel.Init()
 			} else if m.cursor == 1 {
+				m.state = StateSendText
+				m.sendTextModel = NewSendTextModel(m.sendTextModel.mailboxURL, m.sendTextModel.relay, m.sendTextModel.verify)
+				return m, m.sendTextModel.Init()
+			} else if m.cursor == 2 {
 				m.state = StateReceive
-				m.receiveModel = NewReceiveModel(m.receiveModel.mailboxURL)
+				m.receiveModel = NewReceiveModel(m.receiveModel.mailboxURL, m.receiveModel.relay, m.receiveModel.verify)
 				return m, m.receiveModel.Init()
 			} else {
 				m.state = StateSettings
@@ -124,6 +142,8 @@ func (m Model) View() string {
 		content = m.viewMenu()
 	case StateSend:
 		content = m.sendModel.View()
+	case StateSendText:
+		content = m.sendTextModel.View()
 	case StateReceive:
 		content = m.receiveModel.View()
 	case StateSettings:
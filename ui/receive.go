@@ -3,11 +3,16 @@ package ui
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/frostbyte57/GoPipe/internal/transit"
+	"github.com/frostbyte57/GoPipe/internal/words"
 	"github.com/frostbyte57/GoPipe/internal/wormhole"
 
 	"github.com/charmbracelet/bubbles/progress"
 	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
@@ -17,14 +22,29 @@ type ReceiveModel struct {
 	textInput     textinput.Model
 	progressBar   progress.Model
 	status        string
+	code          string // generated by us, for the sender to use
 	receiving     bool
+	offer         *transit.Metadata // waiting for the user to accept it
+	accepted      *transit.Metadata // the offer being received
+	declined      bool
+	declineReason string // why the offer was declined without asking
+	verify        bool   // wait for the user to compare the verifier
+	verifying     bool
+	verifier      string
+	message       *viewport.Model // a received text message
 	transferring  bool
+	reconnect     bool
 	done          bool
 	err           error
 	mailboxURL    string
+	relay         string
+	nameplates    []string // in use on the mailbox server, for completion
+	listedAt      time.Time
 	progress      float64
 	receivedBytes int64
 	totalBytes    int64
+	rate          float64
+	files         TxProgressMsg
 	transferSub   ReceiveTransferStartedMsg
 }
 
@@ -34,10 +54,11 @@ type ReceiveTransferStartedMsg struct {
 	ResultChan   <-chan string
 }
 
-func NewReceiveModel(mailboxURL string) ReceiveModel {
+func NewReceiveModel(mailboxURL string, relay string, verify bool) ReceiveModel {
 	ti := textinput.New()
-	ti.Placeholder = "7-code-words"
+	ti.Placeholder = "7-guitarist-revenge"
 	ti.Focus()
+	ti.ShowSuggestions = true
 	ti.CharLimit = 156
 	ti.Width = 40
 	ti.TextStyle = lipgloss.NewStyle().Foreground(ColorText)
@@ -57,11 +78,13 @@ func NewReceiveModel(mailboxURL string) ReceiveModel {
 		progressBar: prog,
 		status:      "Enter Wormhole Code:",
 		mailboxURL:  mailboxURL,
+		relay:       relay,
+		verify:      verify,
 	}
 }
 
 func (m ReceiveModel) Init() tea.Cmd {
-	return textinput.Blink
+	return tea.Batch(textinput.Blink, listNameplates(m.mailboxURL))
 }
 
 func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -69,33 +92,119 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if m.message != nil && msg.Type != tea.KeyEsc {
+			vp, cmd := m.message.Update(msg)
+			m.message = &vp
+			return m, cmd
+		}
+		if m.verifying {
+			switch msg.String() {
+			case "y":
+				m.verifying = false
+				return m, waitForOffer(m.client)
+			case "n", "esc":
+				m.verifying = false
+				return m, rejectVerifier(m.client)
+			}
+			return m, nil
+		}
+		if m.offer != nil {
+			switch msg.String() {
+			case "y", "enter":
+				m.accepted, m.offer = m.offer, nil
+				m.status = "Receiving..."
+				m.transferring = true
+				return m, startReceiveTransfer(m.client)
+			case "n", "esc":
+				m.offer = nil
+				return m, rejectOffer(m.client)
+			}
+			return m, nil
+		}
 		switch msg.Type {
 		case tea.KeyEnter:
 			if !m.receiving && !m.done {
-				code := m.textInput.Value()
+				code := strings.TrimSpace(m.textInput.Value())
 				m.receiving = true
 				m.status = "Connecting..."
-				return m, startReceive(code, m.mailboxURL)
+				if code == "" {
+					return m, startRequest(m.mailboxURL, m.relay)
+				}
+				code, err := words.Normalize(code)
+				if err != nil {
+					m.err = err
+					m.receiving = false
+					return m, nil
+				}
+				m.textInput.SetValue(code)
+				return m, startReceive(code, m.mailboxURL, m.relay)
 			}
 		case tea.KeyEsc:
 			return m, func() tea.Msg { return BackToMenuMsg{} }
 		}
 
+	case NameplatesMsg:
+		m.nameplates = msg
+		m.listedAt = time.Now()
+		m.textInput.SetSuggestions(words.Complete(m.textInput.Value(), m.nameplates, words.DefaultLength))
+		return m, nil
+
+	case RequestedMsg:
+		m.code = msg.Code
+		m.client = msg.Client
+		m.status = "Waiting for the sender..."
+		return m, waitForSender(m.client, m.code)
+
 	case ConnectedMsg:
 		m.client = msg.Client
-		m.status = "Connected! Receiving..."
-		m.transferring = true
-		return m, startReceiveTransfer(m.client)
+		m.verifier = verifierOf(m.client)
+		m.status = "Connected! Waiting for the offer..."
+		if m.verify {
+			m.verifying = true
+			return m, nil
+		}
+		return m, waitForOffer(m.client)
+
+	case OfferMsg:
+		if msg.Meta.Mode == "text" {
+			m.status = "Receiving text..."
+			return m, receiveText(m.client)
+		}
+		if msg.Meta.Mode == "session" {
+			m.declineReason = "The sender opened a session, which cannot be joined here.\nAsk for a new code and join it with \"gopipe session <code>\"."
+			return m, rejectOffer(m.client)
+		}
+		m.offer = &msg.Meta
+		return m, nil
+
+	case TextReceivedMsg:
+		text := lipgloss.NewStyle().Width(messageWidth).Render(msg.Text)
+		vp := viewport.New(messageWidth, min(lipgloss.Height(text), 12))
+		vp.SetContent(text)
+		m.message = &vp
+		m.receiving = false
+		return m, nil
+
+	case DeclinedMsg:
+		m.declined = true
+		m.receiving = false
+		return m, nil
 
 	case ReceiveTransferStartedMsg:
 		m.transferSub = msg
 		return m, listenReceiveTransfer(msg)
 
 	case TxProgressMsg:
+		m.reconnect = msg.Reconnecting
+		if m.reconnect {
+			return m, m.waitForNextReceiveProgress()
+		}
 		var cmds []tea.Cmd
 		m.progress = msg.Ratio
 		m.receivedBytes = msg.Current
 		m.totalBytes = msg.Total
+		m.rate = msg.Rate
+		m.files = msg
 
 		if m.progress >= 1.0 {
 			cmd := m.progressBar.SetPercent(1.0)
@@ -116,7 +225,11 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.done = true
 		m.receiving = false
 		m.transferring = false
-		m.status = fmt.Sprintf("Received File! (saved as '%s')", msg.Filename)
+		if m.accepted != nil && m.accepted.Mode == "multi" {
+			m.status = fmt.Sprintf("Received %d Items! (saved as %s)", len(m.accepted.Entries), msg.Filename)
+		} else {
+			m.status = fmt.Sprintf("Received File! (saved as '%s')", msg.Filename)
+		}
 		return m, tea.Quit
 
 	case ErrorMsg:
@@ -129,6 +242,7 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	if m.err != nil {
 		if msg, ok := msg.(tea.KeyMsg); ok && msg.Type == tea.KeyEsc {
 			m.err = nil
+			m.code = ""
 			m.status = "Enter Wormhole Code:"
 			m.textInput.SetValue("")
 			m.textInput.Focus()
@@ -138,9 +252,21 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 
 	m.textInput, cmd = m.textInput.Update(msg)
+	value := m.textInput.Value()
+	m.textInput.SetSuggestions(words.Complete(value, m.nameplates, words.DefaultLength))
+	// Codes are usually typed right after the sender got theirs, so the list
+	// from when the screen opened is likely stale.
+	if _, ok := msg.(tea.KeyMsg); ok && !strings.Contains(value, "-") && time.Since(m.listedAt) > nameplatesMaxAge {
+		m.listedAt = time.Now()
+		return m, tea.Batch(cmd, listNameplates(m.mailboxURL))
+	}
 	return m, cmd
 }
 
+// nameplatesMaxAge is how long the nameplates listed for completion are used
+// before asking the mailbox server again.
+const nameplatesMaxAge = 3 * time.Second
+
 func (m ReceiveModel) View() string {
 	if m.err != nil {
 		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
@@ -154,27 +280,94 @@ func (m ReceiveModel) View() string {
 		return fmt.Sprintf("\n%s\n\n%s", TitleStyle.Render("Success"), StatusStyle.Foreground(ColorSuccess).Render(m.status))
 	}
 
+	if m.declined {
+		reason := "The sender has been told that you declined."
+		if m.declineReason != "" {
+			reason = m.declineReason
+		}
+		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
+			TitleStyle.Render("Declined"),
+			StatusStyle.Render(reason),
+			HelpStyle.Render("Press Esc to go back"),
+		)
+	}
+
+	if m.message != nil {
+		help := "Esc to go back"
+		if !m.message.AtTop() || !m.message.AtBottom() {
+			help = "Up/Down to scroll, Esc to go back"
+		}
+		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
+			TitleStyle.Render("Message Received"),
+			m.message.View(),
+			HelpStyle.Render(help),
+		)
+	}
+
+	if m.verifying {
+		return verifyView(m.verifier, "sender")
+	}
+
+	if m.offer != nil {
+		offer := describeOffer(*m.offer)
+		if !m.verify {
+			offer += "\n\n" + verifierLine(m.verifier)
+		}
+		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
+			TitleStyle.Render("Incoming Transfer"),
+			StatusStyle.Render(offer),
+			HelpStyle.Render("Press y to accept, n to decline"),
+		)
+	}
+
+	if m.receiving && !m.transferring && m.code != "" {
+		return fmt.Sprintf("\n%s\n%s\n\n%s\n\n%s",
+			TitleStyle.Render("Ready to Receive"),
+			CodeBoxStyle.Render(m.code),
+			StatusStyle.Render("Share this code with the sender. They run:\ngopipe send -code "+m.code+" <path>"),
+			StatusStyle.Render(m.status),
+		)
+	}
+
+	if m.receiving && !m.transferring {
+		return fmt.Sprintf("\n%s\n\n%s",
+			TitleStyle.Render("Receive File"),
+			StatusStyle.Render(m.status),
+		)
+	}
+
 	if m.transferring {
+		status := transferStatus(m.receivedBytes, m.totalBytes, m.progress, m.rate)
+		if line := fileStatus(m.files); line != "" {
+			status += "\n" + line
+		}
+		if !m.verify {
+			status += "\n" + verifierLine(m.verifier)
+		}
+		if m.reconnect {
+			status = "Connection lost, reconnecting…"
+		}
+		bar := m.progressBar.View()
+		if m.totalBytes < 0 {
+			bar = indeterminateBar(m.progressBar.Width, m.receivedBytes)
+		}
 		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
 			TitleStyle.Render("Receiving File..."),
-			m.progressBar.View(),
-			StatusStyle.Render(fmt.Sprintf("%s / %s (%.0f%%)",
-				byteCountBinary(m.receivedBytes),
-				byteCountBinary(m.totalBytes),
-				m.progress*100)),
+			bar,
+			StatusStyle.Render(status),
 		)
 	}
 
 	return fmt.Sprintf("\n%s\n\n%s\n\n%s",
 		TitleStyle.Render("Receive File"),
 		m.textInput.View(),
-		HelpStyle.Render("Enter Wormhole Code (e.g. 7-words)"),
+		HelpStyle.Render("Enter Wormhole Code (Tab completes), or leave it empty to generate one for the sender"),
 	)
 }
 
-func startReceive(code string, mailboxURL string) tea.Cmd {
+func startReceive(code string, mailboxURL string, relay string) tea.Cmd {
 	return func() tea.Msg {
-		c := wormhole.NewClient("", mailboxURL)
+		c := wormhole.NewClient("", mailboxURL, relay)
 		ctx := context.Background()
 
 		if err := c.PrepareReceive(ctx, code); err != nil {
@@ -190,6 +383,112 @@ func startReceive(code string, mailboxURL string) tea.Cmd {
 	}
 }
 
+// listNameplates fetches the nameplates in use for completion. Failing is
+// not an error: codes can be typed without completion.
+func listNameplates(mailboxURL string) tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		nameplates, err := wormhole.ListNameplates(ctx, mailboxURL)
+		if err != nil {
+			return nil
+		}
+		return NameplatesMsg(nameplates)
+	}
+}
+
+// startRequest generates a code for the sender to send with, so that the
+// receiver does not have to wait for one.
+func startRequest(mailboxURL string, relay string) tea.Cmd {
+	return func() tea.Msg {
+		c := wormhole.NewClient("", mailboxURL, relay)
+		code, err := c.PrepareRequest(context.Background())
+		if err != nil {
+			return ErrorMsg(err)
+		}
+		return RequestedMsg{Code: code, Client: c}
+	}
+}
+
+func waitForSender(c *wormhole.Client, code string) tea.Cmd {
+	return func() tea.Msg {
+		if _, err := c.PerformHandshake(context.Background()); err != nil {
+			return ErrorMsg(err)
+		}
+		return ConnectedMsg{Code: code, Client: c}
+	}
+}
+
+// describeOffer lists what the sender offers.
+func describeOffer(meta transit.Metadata) string {
+	if meta.Mode == "multi" {
+		lines := []string{
+			fmt.Sprintf("Items: %d", len(meta.Entries)),
+			fmt.Sprintf("Files: %d", meta.Files),
+			fmt.Sprintf("Size:  %s", byteCountBinary(meta.RawSize)),
+			"",
+		}
+		for i, e := range meta.Entries {
+			if i == maxOfferEntries && len(meta.Entries) > maxOfferEntries+1 {
+				lines = append(lines, fmt.Sprintf("  … and %d more", len(meta.Entries)-i))
+				break
+			}
+			if e.Mode == "dir" {
+				lines = append(lines, fmt.Sprintf("  %s/ (%d files, %s)", e.Name, e.Files, byteCountBinary(e.Size)))
+			} else {
+				lines = append(lines, fmt.Sprintf("  %s (%s)", e.Name, byteCountBinary(e.Size)))
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	if meta.Mode == "dir" {
+		size := meta.RawSize
+		if size == 0 {
+			size = meta.Size
+		}
+		return fmt.Sprintf("Directory: %s\nFiles:     %d\nSize:      %s", meta.Name, meta.Files, byteCountBinary(size))
+	}
+	if meta.Size < 0 {
+		return fmt.Sprintf("File: %s\nSize: unknown (streamed)", meta.Name)
+	}
+	return fmt.Sprintf("File: %s\nSize: %s", meta.Name, byteCountBinary(meta.Size))
+}
+
+// maxOfferEntries is how many entries of a multi-file offer are listed.
+const maxOfferEntries = 8
+
+// messageWidth is the width text messages are written and shown at.
+const messageWidth = 54
+
+func receiveText(c *wormhole.Client) tea.Cmd {
+	return func() tea.Msg {
+		text, err := c.ReceiveText(context.Background())
+		if err != nil {
+			return ErrorMsg(err)
+		}
+		return TextReceivedMsg{Text: text}
+	}
+}
+
+func waitForOffer(c *wormhole.Client) tea.Cmd {
+	return func() tea.Msg {
+		meta, err := c.ReceiveOffer(context.Background())
+		if err != nil {
+			return ErrorMsg(err)
+		}
+		return OfferMsg{Meta: meta}
+	}
+}
+
+func rejectOffer(c *wormhole.Client) tea.Cmd {
+	return func() tea.Msg {
+		if err := c.RejectOffer(context.Background()); err != nil {
+			return ErrorMsg(err)
+		}
+		return DeclinedMsg{}
+	}
+}
+
 func (m ReceiveModel) waitForNextReceiveProgress() tea.Cmd {
 	return listenReceiveTransfer(m.transferSub)
 }
@@ -209,9 +508,16 @@ func startReceiveTransfer(c *wormhole.Client) tea.Cmd {
 			go func() {
 				for p := range whProgressChan {
 					progressChan <- TxProgressMsg{
-						Current: p.Current,
-						Total:   p.Total,
-						Ratio:   p.Ratio,
+						Current:      p.Current,
+						Total:        p.Total,
+						Ratio:        p.Ratio,
+						Rate:         p.Rate,
+						File:         p.File,
+						FileCurrent:  p.FileCurrent,
+						FileTotal:    p.FileTotal,
+						FilesDone:    p.FilesDone,
+						FilesTotal:   p.FilesTotal,
+						Reconnecting: p.Reconnecting,
 					}
 				}
 			}()
@@ -0,0 +1,44 @@
+package ui
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/frostbyte57/GoPipe/internal/transit"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestReceiveMultiDone(t *testing.T) {
+	m := NewReceiveModel("", "", false)
+	m.offer = &transit.Metadata{Name: "2 items", Mode: "multi", Entries: []transit.Entry{{Name: "a"}, {Name: "b"}}}
+
+	model, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("y")})
+	model, _ = model.Update(TransferDoneMsg{Filename: "a, b"})
+	if status := model.(ReceiveModel).status; !strings.HasPrefix(status, "Received 2 Items!") {
+		t.Errorf("status %q after receiving two items", status)
+	}
+}
+
+func TestReceiveFileDone(t *testing.T) {
+	m := NewReceiveModel("", "", false)
+	m.offer = &transit.Metadata{Name: "a.txt", Mode: "file", Size: 3}
+
+	model, _ := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	model, _ = model.Update(TransferDoneMsg{Filename: "a.txt"})
+	if status := model.(ReceiveModel).status; status != "Received File! (saved as 'a.txt')" {
+		t.Errorf("status %q after receiving a file", status)
+	}
+}
+
+func TestReceiveSessionDeclined(t *testing.T) {
+	m := NewReceiveModel("", "", false)
+	model, cmd := m.Update(OfferMsg{Meta: transit.Metadata{Name: "session", Mode: "session"}})
+	if cmd == nil || model.(ReceiveModel).offer != nil {
+		t.Fatal("a session offer was put to the user instead of declined")
+	}
+	model, _ = model.Update(DeclinedMsg{})
+	if view := model.View(); !strings.Contains(view, "gopipe session") {
+		t.Errorf("the declined screen does not say how to join the session:\n%s", view)
+	}
+}
@@ -2,9 +2,12 @@ package ui
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/frostbyte57/GoPipe/internal/words"
 	"github.com/frostbyte57/GoPipe/internal/wormhole"
 
 	"github.com/charmbracelet/bubbles/progress"
@@ -16,18 +19,29 @@ import (
 type SendModel struct {
 	client      *wormhole.Client
 	textInput   textinput.Model
+	codeInput   textinput.Model // optional code generated by the receiver
 	progressBar progress.Model
+	paths       []string
 	code        string
+	joined      bool // code came from the receiver
 	status      string
 	progress    float64
 	sentBytes   int64
 	totalBytes  int64
+	rate        float64
+	files       TxProgressMsg
 	err         error
 	sending     bool
 	uploading   bool
+	accepted    bool // the receiver accepted the offer
+	verify      bool // wait for the user to compare the verifier
+	verifying   bool
+	verifier    string
+	reconnect   bool
 	done        bool
 	transferSub TransferStartedMsg
 	mailboxURL  string
+	relay       string
 }
 
 type TransferStartedMsg struct {
@@ -36,15 +50,22 @@ type TransferStartedMsg struct {
 	DoneChan     <-chan struct{}
 }
 
-func NewSendModel(mailboxURL string) SendModel {
+func NewSendModel(mailboxURL string, relay string, verify bool) SendModel {
 	ti := textinput.New()
 	ti.Placeholder = "/path/to/file"
 	ti.Focus()
-	ti.CharLimit = 156
+	ti.CharLimit = 1024
 	ti.Width = 40
 	ti.TextStyle = lipgloss.NewStyle().Foreground(ColorText)
 	ti.Cursor.Style = lipgloss.NewStyle().Foreground(ColorGoBlue)
 
+	ci := textinput.New()
+	ci.Placeholder = "code from the receiver (optional)"
+	ci.CharLimit = 156
+	ci.Width = 40
+	ci.TextStyle = ti.TextStyle
+	ci.Cursor.Style = ti.Cursor.Style
+
 	prog := progress.New(
 		progress.WithSolidFill(string(ColorGreen)),
 		progress.WithWidth(40),
@@ -56,9 +77,12 @@ func NewSendModel(mailboxURL string) SendModel {
 
 	return SendModel{
 		textInput:   ti,
+		codeInput:   ci,
 		progressBar: prog,
 		status:      "Enter file path:",
 		mailboxURL:  mailboxURL,
+		relay:       relay,
+		verify:      verify,
 	}
 }
 
@@ -71,13 +95,45 @@ func (m SendModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if m.verifying {
+			switch msg.String() {
+			case "y":
+				m.verifying = false
+				m.status = "Connected! Sending..."
+				m.uploading = true
+				return m, startTransfer(m.client, m.paths)
+			case "n", "esc":
+				m.verifying = false
+				return m, rejectVerifier(m.client)
+			}
+			return m, nil
+		}
 		switch msg.Type {
 		case tea.KeyEnter:
 			if !m.sending && !m.done {
-				filePath := m.textInput.Value()
+				paths, err := wormhole.ExpandPaths(wormhole.SplitPaths(m.textInput.Value()))
+				if err != nil {
+					m.err = err
+					return m, nil
+				}
+				if len(paths) == 0 {
+					return m, nil
+				}
+				m.paths = paths
 				m.sending = true
 				m.status = "Connecting..."
-				return m, startSend(filePath, m.mailboxURL)
+				code := strings.TrimSpace(m.codeInput.Value())
+				m.joined = code != ""
+				return m, startSend(m.paths, code, m.mailboxURL, m.relay)
+			}
+		case tea.KeyTab, tea.KeyShiftTab:
+			if !m.sending && !m.done {
+				if m.textInput.Focused() {
+					m.textInput.Blur()
+					return m, m.codeInput.Focus()
+				}
+				m.codeInput.Blur()
+				return m, m.textInput.Focus()
 			}
 		case tea.KeyEsc:
 			return m, func() tea.Msg { return BackToMenuMsg{} }
@@ -86,23 +142,38 @@ func (m SendModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case ConnectedMsg:
 		m.code = msg.Code
 		m.client = msg.Client
-		m.status = fmt.Sprintf("Code: %s\nWaiting for receiver...", m.code)
+		m.status = "Share this code with the receiver."
+		if m.joined {
+			m.status = "Waiting for the receiver..."
+		}
 		return m, waitForReceiver(m.client, m.textInput.Value(), 0)
 
 	case HandshakeSuccessMsg:
+		m.verifier = verifierOf(m.client)
+		if m.verify {
+			m.verifying = true
+			return m, nil
+		}
 		m.status = "Connected! Sending..."
 		m.uploading = true
-		return m, startTransfer(m.client, m.textInput.Value())
+		return m, startTransfer(m.client, m.paths)
 
 	case TransferStartedMsg:
 		m.transferSub = msg
 		return m, listenTransfer(msg)
 
 	case TxProgressMsg:
+		m.reconnect = msg.Reconnecting
+		if m.reconnect {
+			return m, m.waitForNextProgress()
+		}
 		var cmds []tea.Cmd
+		m.accepted = true
 		m.progress = msg.Ratio
 		m.sentBytes = msg.Current
 		m.totalBytes = msg.Total
+		m.rate = msg.Rate
+		m.files = msg
 
 		if m.progress >= 1.0 {
 			cmd := m.progressBar.SetPercent(1.0)
@@ -131,11 +202,23 @@ func (m SendModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 	}
 
+	if m.codeInput.Focused() {
+		m.codeInput, cmd = m.codeInput.Update(msg)
+		return m, cmd
+	}
 	m.textInput, cmd = m.textInput.Update(msg)
 	return m, cmd
 }
 
 func (m SendModel) View() string {
+	if errors.Is(m.err, wormhole.ErrDeclined) {
+		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
+			TitleStyle.Render("Declined"),
+			StatusStyle.Render("The receiver declined the transfer."),
+			HelpStyle.Render("Press Esc to go back"),
+		)
+	}
+
 	if m.err != nil {
 		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
 			TitleStyle.Render("Error"),
@@ -148,14 +231,35 @@ func (m SendModel) View() string {
 		return fmt.Sprintf("\n%s\n\n%s", TitleStyle.Render("Success"), StatusStyle.Foreground(ColorSuccess).Render(m.status))
 	}
 
+	if m.verifying {
+		return verifyView(m.verifier, "receiver")
+	}
+
 	if m.uploading {
+		status := transferStatus(m.sentBytes, m.totalBytes, m.progress, m.rate)
+		if line := fileStatus(m.files); line != "" {
+			status += "\n" + line
+		}
+		if m.reconnect {
+			status = "Connection lost, reconnecting…"
+		} else if !m.accepted {
+			status = "Waiting for the receiver to accept…"
+		}
+		if !m.verify {
+			status += "\n" + verifierLine(m.verifier)
+		}
+		bar := m.progressBar.View()
+		if m.totalBytes < 0 {
+			bar = indeterminateBar(m.progressBar.Width, m.sentBytes)
+		}
+		title := "Sending File..."
+		if len(m.paths) > 1 {
+			title = fmt.Sprintf("Sending %d Items...", len(m.paths))
+		}
 		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
-			TitleStyle.Render("Sending File..."),
-			m.progressBar.View(),
-			StatusStyle.Render(fmt.Sprintf("%s / %s (%.0f%%)",
-				byteCountBinary(m.sentBytes),
-				byteCountBinary(m.totalBytes),
-				m.progress*100)),
+			TitleStyle.Render(title),
+			bar,
+			StatusStyle.Render(status),
 		)
 	}
 
@@ -164,31 +268,43 @@ func (m SendModel) View() string {
 		return fmt.Sprintf("\n%s\n%s\n\n%s",
 			TitleStyle.Render("Ready to Send"),
 			codeBox,
-			StatusStyle.Render("Share this code with the receiver."),
+			StatusStyle.Render(m.status),
 		)
 	}
 
 	// Input State
-	return fmt.Sprintf("\n%s\n\n%s\n\n%s",
+	return fmt.Sprintf("\n%s\n\n%s\n%s\n\n%s",
 		TitleStyle.Render("Send File"),
 		m.textInput.View(),
-		HelpStyle.Render("Enter absolute path to file"),
+		m.codeInput.View(),
+		HelpStyle.Render("Enter paths to files or directories, separated by spaces.\nTab to enter a code the receiver generated."),
 	)
 }
 
-func startSend(filePath string, mailboxURL string) tea.Cmd {
+// startSend generates a code for the receiver, or joins the receiver that
+// generated code.
+func startSend(paths []string, code string, mailboxURL string, relay string) tea.Cmd {
 	return func() tea.Msg {
-		file, err := os.Open(filePath)
-		if err != nil {
-			return ErrorMsg(err)
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				return ErrorMsg(err)
+			}
 		}
-		stat, _ := file.Stat()
-		_ = stat.Size()
-		file.Close()
 
-		c := wormhole.NewClient("", mailboxURL)
+		c := wormhole.NewClient("", mailboxURL, relay)
 		ctx := context.Background()
 
+		if code != "" {
+			code, err := words.Normalize(code)
+			if err != nil {
+				return ErrorMsg(err)
+			}
+			if err := c.PrepareSendCode(ctx, code); err != nil {
+				return ErrorMsg(err)
+			}
+			return ConnectedMsg{Code: code, Client: c}
+		}
+
 		code, err := c.PrepareSend(ctx)
 		if err != nil {
 			return ErrorMsg(err)
@@ -213,7 +329,7 @@ func waitForReceiver(c *wormhole.Client, filePath string, fileSize int64) tea.Cm
 	}
 }
 
-func startTransfer(c *wormhole.Client, filePath string) tea.Cmd {
+func startTransfer(c *wormhole.Client, paths []string) tea.Cmd {
 	return func() tea.Msg {
 		progressChan := make(chan TxProgressMsg, 100)
 		errChan := make(chan error, 1)
@@ -228,14 +344,21 @@ func startTransfer(c *wormhole.Client, filePath string) tea.Cmd {
 			go func() {
 				for p := range whProgressChan {
 					progressChan <- TxProgressMsg{
-						Current: p.Current,
-						Total:   p.Total,
-						Ratio:   p.Ratio,
+						Current:      p.Current,
+						Total:        p.Total,
+						Ratio:        p.Ratio,
+						Rate:         p.Rate,
+						File:         p.File,
+						FileCurrent:  p.FileCurrent,
+						FileTotal:    p.FileTotal,
+						FilesDone:    p.FilesDone,
+						FilesTotal:   p.FilesTotal,
+						Reconnecting: p.Reconnecting,
 					}
 				}
 			}()
 
-			err := c.SendFile(context.Background(), filePath, whProgressChan)
+			err := c.SendFiles(context.Background(), paths, whProgressChan)
 			if err != nil {
 				errChan <- err
 				return
@@ -266,6 +389,42 @@ func listenTransfer(sub TransferStartedMsg) tea.Cmd {
 	}
 }
 
+// transferStatus shows the bytes transferred, out of total unless that is
+// unknown, and the rate.
+func transferStatus(current, total int64, ratio, rate float64) string {
+	if total < 0 {
+		return fmt.Sprintf("%s, %s/s", byteCountBinary(current), byteCountBinary(int64(rate)))
+	}
+	return fmt.Sprintf("%s / %s (%.0f%%), %s/s",
+		byteCountBinary(current),
+		byteCountBinary(total),
+		ratio*100,
+		byteCountBinary(int64(rate)))
+}
+
+// indeterminateBar is the progress bar of a transfer of unknown size: a
+// block that moves along as data arrives.
+func indeterminateBar(width int, current int64) string {
+	const block = 8
+	pos := int(current>>20) % (width - block + 1)
+	return lipgloss.NewStyle().Foreground(ColorSubtle).Render(strings.Repeat("░", pos)) +
+		lipgloss.NewStyle().Foreground(ColorGreen).Render(strings.Repeat("█", block)) +
+		lipgloss.NewStyle().Foreground(ColorSubtle).Render(strings.Repeat("░", width-block-pos))
+}
+
+// fileStatus describes the file being transferred as part of a directory
+// or of several files.
+func fileStatus(p TxProgressMsg) string {
+	if p.FilesTotal == 0 {
+		return ""
+	}
+	name := p.File
+	if p.FileTotal > 0 {
+		name += fmt.Sprintf(" %.0f%%", float64(p.FileCurrent)/float64(p.FileTotal)*100)
+	}
+	return fmt.Sprintf("%s (%d/%d files)", name, p.FilesDone, p.FilesTotal)
+}
+
 func byteCountBinary(b int64) string {
 	const unit = 1024
 	if b < unit {
@@ -0,0 +1,178 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/frostbyte57/GoPipe/internal/wormhole"
+
+	"github.com/charmbracelet/bubbles/textarea"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// SendTextModel sends a short text message, such as a token or a URL,
+// without going through a file.
+type SendTextModel struct {
+	client     *wormhole.Client
+	textArea   textarea.Model
+	code       string
+	status     string
+	err        error
+	sending    bool
+	done       bool
+	verify     bool // wait for the user to compare the verifier
+	verifying  bool
+	verifier   string
+	mailboxURL string
+	relay      string
+}
+
+func NewSendTextModel(mailboxURL string, relay string, verify bool) SendTextModel {
+	ta := textarea.New()
+	ta.Placeholder = "Token, URL or snippet..."
+	ta.ShowLineNumbers = false
+	ta.SetWidth(messageWidth)
+	ta.SetHeight(6)
+	ta.Focus()
+
+	return SendTextModel{
+		textArea:   ta,
+		status:     "Enter text:",
+		verify:     verify,
+		mailboxURL: mailboxURL,
+		relay:      relay,
+	}
+}
+
+func (m SendTextModel) Init() tea.Cmd {
+	return textarea.Blink
+}
+
+func (m SendTextModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if m.verifying {
+			switch msg.String() {
+			case "y":
+				m.verifying = false
+				m.status = "Connected! Sending..."
+				return m, sendText(m.client, m.textArea.Value())
+			case "n", "esc":
+				m.verifying = false
+				return m, rejectVerifier(m.client)
+			}
+			return m, nil
+		}
+		switch msg.String() {
+		case "ctrl+s":
+			if !m.sending && !m.done && strings.TrimSpace(m.textArea.Value()) != "" {
+				m.sending = true
+				m.status = "Connecting..."
+				return m, startTextSend(m.mailboxURL, m.relay)
+			}
+			return m, nil
+		case "esc":
+			return m, func() tea.Msg { return BackToMenuMsg{} }
+		}
+
+	case ConnectedMsg:
+		m.code = msg.Code
+		m.client = msg.Client
+		m.status = "Share this code with the receiver."
+		return m, waitForReceiver(m.client, "", 0)
+
+	case HandshakeSuccessMsg:
+		m.verifier = verifierOf(m.client)
+		if m.verify {
+			m.verifying = true
+			return m, nil
+		}
+		m.status = "Connected! Sending..."
+		return m, sendText(m.client, m.textArea.Value())
+
+	case TransferDoneMsg:
+		m.done = true
+		m.sending = false
+		m.status = "Text sent!"
+		return m, tea.Quit
+
+	case ErrorMsg:
+		m.err = msg
+		return m, nil
+	}
+
+	if m.sending {
+		return m, nil
+	}
+	m.textArea, cmd = m.textArea.Update(msg)
+	return m, cmd
+}
+
+func (m SendTextModel) View() string {
+	if errors.Is(m.err, wormhole.ErrDeclined) {
+		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
+			TitleStyle.Render("Declined"),
+			StatusStyle.Render("The receiver declined the message."),
+			HelpStyle.Render("Press Esc to go back"),
+		)
+	}
+
+	if m.err != nil {
+		return fmt.Sprintf("\n%s\n\n%s\n\n%s",
+			TitleStyle.Render("Error"),
+			StatusStyle.Foreground(ColorError).Render(m.err.Error()),
+			HelpStyle.Render("Press Esc to go back"),
+		)
+	}
+
+	if m.done {
+		return fmt.Sprintf("\n%s\n\n%s", TitleStyle.Render("Success"), StatusStyle.Foreground(ColorSuccess).Render(m.status))
+	}
+
+	if m.verifying {
+		return verifyView(m.verifier, "receiver")
+	}
+
+	if m.code != "" {
+		codeBox := CodeBoxStyle.Render(m.code)
+		return fmt.Sprintf("\n%s\n%s\n\n%s",
+			TitleStyle.Render("Ready to Send"),
+			codeBox,
+			StatusStyle.Render(m.status),
+		)
+	}
+
+	if m.sending {
+		return fmt.Sprintf("\n%s\n\n%s", TitleStyle.Render("Send Text"), StatusStyle.Render(m.status))
+	}
+
+	return fmt.Sprintf("\n%s\n\n%s\n\n%s",
+		TitleStyle.Render("Send Text"),
+		m.textArea.View(),
+		HelpStyle.Render("Ctrl+S to send, Esc to go back"),
+	)
+}
+
+func startTextSend(mailboxURL string, relay string) tea.Cmd {
+	return func() tea.Msg {
+		c := wormhole.NewClient("", mailboxURL, relay)
+		code, err := c.PrepareSend(context.Background())
+		if err != nil {
+			return ErrorMsg(err)
+		}
+		return ConnectedMsg{Code: code, Client: c}
+	}
+}
+
+func sendText(c *wormhole.Client, text string) tea.Cmd {
+	return func() tea.Msg {
+		if err := c.SendText(context.Background(), text); err != nil {
+			return ErrorMsg(err)
+		}
+		return TransferDoneMsg{}
+	}
+}
@@ -1,6 +1,9 @@
 package ui
 
-import "github.com/frostbyte57/GoPipe/internal/wormhole"
+import (
+	"github.com/frostbyte57/GoPipe/internal/transit"
+	"github.com/frostbyte57/GoPipe/internal/wormhole"
+)
 
 type ErrorMsg error
 type TransferDoneMsg struct {
@@ -9,13 +12,42 @@ type TransferDoneMsg struct {
 type HandshakeSuccessMsg []byte
 type BackToMenuMsg struct{}
 
+// OfferMsg carries the sender's offer, for the receiver to accept or decline.
+type OfferMsg struct {
+	Meta transit.Metadata
+}
+
+// DeclinedMsg is sent once the receiver has declined the offer.
+type DeclinedMsg struct{}
+
+// TextReceivedMsg carries a text message sent instead of a file.
+type TextReceivedMsg struct {
+	Text string
+}
+
+// NameplatesMsg lists the nameplates in use on the mailbox server.
+type NameplatesMsg []string
+
+// RequestedMsg carries the code the receiver generated for the sender.
+type RequestedMsg struct {
+	Code   string
+	Client *wormhole.Client
+}
+
 type ConnectedMsg struct {
 	Code   string
 	Client *wormhole.Client
 }
 
 type TxProgressMsg struct {
-	Current int64
-	Total   int64
-	Ratio   float64
+	Current      int64
+	Total        int64
+	Ratio        float64
+	Rate         float64
+	File         string
+	FileCurrent  int64
+	FileTotal    int64
+	FilesDone    int
+	FilesTotal   int
+	Reconnecting bool
 }
@@ -0,0 +1,39 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/frostbyte57/GoPipe/internal/words"
+	"github.com/frostbyte57/GoPipe/internal/wormhole"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// verifierOf returns the verifier of a connected client as words.
+func verifierOf(c *wormhole.Client) string {
+	return words.Verifier(c.Verifier())
+}
+
+// verifyView asks the user to compare the verifier with what the peer, the
+// sender or the receiver, sees.
+func verifyView(verifier string, peer string) string {
+	return fmt.Sprintf("\n%s\n%s\n\n%s\n\n%s",
+		TitleStyle.Render("Verify the Connection"),
+		CodeBoxStyle.Render(verifier),
+		StatusStyle.Render(fmt.Sprintf("Does the %s see the same words?", peer)),
+		HelpStyle.Render("Press y if they match, n to abort"),
+	)
+}
+
+// verifierLine is shown with transfers that were not paused to verify.
+func verifierLine(verifier string) string {
+	return "Verifier: " + verifier
+}
+
+func rejectVerifier(c *wormhole.Client) tea.Cmd {
+	return func() tea.Msg {
+		c.RejectVerifier(context.Background())
+		return ErrorMsg(wormhole.ErrVerifierMismatch)
+	}
+}